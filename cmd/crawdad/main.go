@@ -0,0 +1,106 @@
+// Command crawdad runs a crawl (optionally streaming each page out in
+// NDJSON, CSV, or WARC as it's fetched via -stream), or dumps a
+// finished crawl's 'done' results in the same formats via -dump.
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/daniel-007/crawdad/crawdad"
+)
+
+func main() {
+	redisURL := flag.String("s", "localhost", "redis host")
+	redisPort := flag.String("p", "6379", "redis port")
+	dump := flag.Bool("dump", false, "dump a finished crawl's 'done' results instead of crawling")
+	stream := flag.Bool("stream", false, "run a live crawl, streaming each page to -format/-o as it's fetched (unlike -dump, this carries page bodies and fetch times)")
+	format := flag.String("format", "ndjson", "output format for -dump/-stream: ndjson, csv, or warc")
+	outPath := flag.String("o", "", "output file for -dump/-stream (defaults to stdout; .gz suffix gzips it)")
+	flag.Parse()
+
+	c, err := crawdad.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	c.RedisURL = *redisURL
+	c.RedisPort = *redisPort
+	if err = c.Init(); err != nil {
+		log.Fatal(err)
+	}
+
+	if *dump && *stream {
+		log.Fatal("-dump and -stream are mutually exclusive")
+	}
+
+	if *dump {
+		if err = dumpCrawl(c, *format, *outPath); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *stream {
+		w, closeOut, err := newWriter(*format, *outPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer closeOut()
+		c.StreamTo(w)
+	}
+
+	if err = c.Crawl(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// dumpCrawl streams c's 'done' results to outPath (or stdout) in the
+// requested format, without loading them into memory first.
+func dumpCrawl(c *crawdad.Crawler, format, outPath string) error {
+	w, closeOut, err := newWriter(format, outPath)
+	if err != nil {
+		return err
+	}
+	defer closeOut()
+	return c.DumpStream(w)
+}
+
+// newWriter opens outPath (or stdout, gzipping if outPath ends in .gz)
+// and wraps it in the Writer for format, for both -dump and -stream.
+// The returned func closes whatever file/gzip.Writer was opened; call
+// it after the Writer is done being written to.
+func newWriter(format, outPath string) (w crawdad.Writer, closeOut func(), err error) {
+	out := io.Writer(os.Stdout)
+	closeOut = func() {}
+	if outPath != "" {
+		f, err := os.Create(outPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		closeOut = func() { f.Close() }
+		out = f
+	}
+	if strings.HasSuffix(outPath, ".gz") {
+		gz := gzip.NewWriter(out)
+		prevClose := closeOut
+		closeOut = func() { gz.Close(); prevClose() }
+		out = gz
+	}
+
+	switch format {
+	case "ndjson":
+		w = crawdad.NewNDJSONWriter(out)
+	case "csv":
+		w = crawdad.NewCSVWriter(out)
+	case "warc":
+		w = crawdad.NewWARCWriter(out)
+	default:
+		return nil, nil, fmt.Errorf("unknown -format %q", format)
+	}
+	return w, closeOut, nil
+}
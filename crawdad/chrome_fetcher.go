@@ -0,0 +1,107 @@
+package crawdad
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+)
+
+// ChromeFetcher fetches rawurl by driving headless Chrome over CDP
+// (chromedp), so JS-heavy pages are returned fully rendered instead of
+// as their initial server-sent HTML. Select it with Settings.Renderer =
+// "chrome", or per-URL via a RendererOverride. The browser process is
+// launched once, lazily, on the first Fetch and reused for every fetch
+// after that; call Close when done with it.
+type ChromeFetcher struct {
+	// WaitFor is a CSS selector chromedp waits to become visible before
+	// considering the page rendered. Empty waits only for navigation.
+	WaitFor string
+	// NetworkIdleTimeout is how long to give in-flight XHR/fetch
+	// requests to settle after WaitFor (or navigation) is satisfied,
+	// before reading back the rendered DOM.
+	NetworkIdleTimeout time.Duration
+	UserAgent          string
+
+	mu          sync.Mutex
+	allocCtx    context.Context
+	cancelAlloc context.CancelFunc
+	browserCtx  context.Context
+}
+
+// browser lazily launches the shared headless Chrome process on first
+// use and returns its context, so repeated fetches reuse one browser
+// instead of spawning a new one per page.
+func (f *ChromeFetcher) browser() (context.Context, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.allocCtx == nil {
+		opts := chromedp.DefaultExecAllocatorOptions[:]
+		if f.UserAgent != "" {
+			opts = append(opts, chromedp.UserAgent(f.UserAgent))
+		}
+		allocCtx, cancelAlloc := chromedp.NewExecAllocator(context.Background(), opts...)
+		// Run with no actions starts the browser now, so contexts made
+		// from browserCtx open tabs in it instead of each allocating
+		// their own browser. Canceling allocCtx also cancels browserCtx.
+		browserCtx, _ := chromedp.NewContext(allocCtx)
+		if err := chromedp.Run(browserCtx); err != nil {
+			cancelAlloc()
+			return nil, err
+		}
+		f.allocCtx, f.cancelAlloc, f.browserCtx = allocCtx, cancelAlloc, browserCtx
+	}
+	return f.browserCtx, nil
+}
+
+// Close shuts down the shared browser process, if Fetch ever launched
+// one.
+func (f *ChromeFetcher) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cancelAlloc != nil {
+		f.cancelAlloc()
+		f.allocCtx, f.cancelAlloc, f.browserCtx = nil, nil, nil
+	}
+}
+
+func (f *ChromeFetcher) Fetch(ctx context.Context, rawurl string) (*Response, error) {
+	browserCtx, err := f.browser()
+	if err != nil {
+		return nil, err
+	}
+	tabCtx, cancelTab := chromedp.NewContext(browserCtx)
+	defer cancelTab()
+
+	// the navigated document's real HTTP status, updated from the CDP
+	// Network domain since chromedp has no higher-level way to read it.
+	// ListenTarget's callback runs on chromedp's own event-dispatch
+	// goroutine, so statusCode needs atomic access rather than a plain
+	// int shared with the goroutine that reads it after chromedp.Run.
+	var statusCode int64 = http.StatusOK
+	chromedp.ListenTarget(tabCtx, func(ev interface{}) {
+		if e, ok := ev.(*network.EventResponseReceived); ok && e.Type == network.ResourceTypeDocument {
+			atomic.StoreInt64(&statusCode, e.Response.Status)
+		}
+	})
+
+	actions := []chromedp.Action{network.Enable(), chromedp.Navigate(rawurl)}
+	if f.WaitFor != "" {
+		actions = append(actions, chromedp.WaitVisible(f.WaitFor, chromedp.ByQuery))
+	}
+	if f.NetworkIdleTimeout > 0 {
+		actions = append(actions, chromedp.Sleep(f.NetworkIdleTimeout))
+	}
+
+	var html string
+	actions = append(actions, chromedp.OuterHTML("html", &html, chromedp.ByQuery))
+
+	if err := chromedp.Run(tabCtx, actions...); err != nil {
+		return nil, err
+	}
+	return &Response{StatusCode: int(atomic.LoadInt64(&statusCode)), Header: http.Header{}, Body: []byte(html)}, nil
+}
@@ -3,27 +3,28 @@ package crawdad
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"math"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/schollz/pluck/pluck"
+	"go.uber.org/zap"
 	pb "gopkg.in/cheggaaa/pb.v1"
 
 	"golang.org/x/net/proxy"
 
-	humanize "github.com/dustin/go-humanize"
+	"github.com/daniel-007/crawdad/crawdad/queue"
 	"github.com/go-redis/redis"
 	"github.com/goware/urlx"
-	"github.com/jcelliott/lumber"
 	"github.com/pkg/errors"
 	"github.com/schollz/collectlinks"
 )
@@ -37,6 +38,73 @@ type Settings struct {
 	AllowQueryParameters bool
 	AllowHashParameters  bool
 	DontFollowLinks      bool
+
+	// RespectRobots makes the crawler fetch, cache, and obey each host's
+	// /robots.txt before scraping any of its URLs.
+	RespectRobots bool
+	// DefaultCrawlDelay is used as the per-host delay when a host's
+	// robots.txt does not specify its own Crawl-delay.
+	DefaultCrawlDelay time.Duration
+	// PerHostQPS caps the number of requests/second any crawdad instance
+	// will make to a single host, shared across distributed workers via
+	// a Redis-backed token bucket.
+	PerHostQPS float64
+
+	// QueueBackend selects the storage backend for the todo/doing/done/
+	// trash lists: "redis" (default), "sentinel" (Redis Sentinel or
+	// Cluster, see QueueConnStr), or "bolt" (embedded, zero-dependency).
+	QueueBackend string
+	// QueueConnStr configures the "sentinel" backend, e.g.
+	// "addrs=host1:6379,host2:6379 master=mymaster db=0".
+	QueueConnStr string
+
+	// LeaseTimeout is how long a worker may hold a leased URL before the
+	// reaper assumes it crashed and returns the URL to the ready queue.
+	LeaseTimeout time.Duration
+	// MaxAttempts is how many times a URL may be leased and failed
+	// before it's dead-lettered to 'trash' instead of retried.
+	MaxAttempts int
+
+	// DedupContent enables the content-aware dedup subsystem: a fetched
+	// page's <link rel="canonical"> / Content-Location is used as the
+	// 'done' key instead of the crawled URL, and a SimHash fingerprint
+	// of its visible text is checked against prior fingerprints so
+	// near-duplicate pages can be flagged instead of only exact-URL
+	// duplicates.
+	DedupContent bool
+	// SimHashThreshold is the maximum Hamming distance between two
+	// pages' SimHash fingerprints for them to be considered
+	// near-duplicates. Defaults to 3.
+	SimHashThreshold int
+
+	// Renderer selects the Fetcher used to retrieve pages: "http"
+	// (default) fetches with plain net/http, while "chrome" renders the
+	// page in headless Chrome first, for JS-heavy sites. See
+	// RendererOverrides to mix the two within one crawl.
+	Renderer string
+	// RendererOverrides picks Renderer for URLs whose path matches
+	// Pattern, checked in order; the first match wins, and
+	// Settings.Renderer is the fallback for URLs that match none.
+	RendererOverrides []RendererOverride
+	// ChromeWaitFor is a CSS selector the "chrome" Renderer waits to
+	// become visible before treating a page as rendered.
+	ChromeWaitFor string
+	// ChromeNetworkIdleTimeout is how long the "chrome" Renderer waits
+	// for in-flight requests to settle before reading back the DOM.
+	ChromeNetworkIdleTimeout time.Duration
+
+	// MetricsAddr, if set, serves Prometheus metrics (crawdad_urls_fetched_total,
+	// crawdad_queue_size, crawdad_fetch_duration_seconds,
+	// crawdad_http_status_total, crawdad_errors_total) on that address
+	// at /metrics. Disabled when empty.
+	MetricsAddr string
+}
+
+// RendererOverride picks a non-default Renderer for URLs whose path
+// matches Pattern (a path.Match glob, e.g. "/app/*").
+type RendererOverride struct {
+	Pattern  string
+	Renderer string
 }
 
 // Crawler is the crawler instance
@@ -53,12 +121,13 @@ type Crawler struct {
 	UseProxy                 bool
 	UserAgent                string
 	EraseDB                  bool
+	BoltPath                 string
 
 	// Public  options
 	Settings Settings
 
 	// Private instance parameters
-	log                *lumber.ConsoleLogger
+	log                *zap.SugaredLogger
 	programTime        time.Time
 	numberOfURLSParsed int
 	numTrash           int64
@@ -68,10 +137,15 @@ type Crawler struct {
 	isRunning          bool
 	errors             int64
 	client             *http.Client
-	todo               *redis.Client
-	doing              *redis.Client
-	done               *redis.Client
-	trash              *redis.Client
+	jobs               queue.LeaseQueue
+	done               queue.Queue
+	trash              queue.Queue
+	robots             *redis.Client
+	dedup              *redis.Client
+	stream             *streamPipeline
+	httpFetcher        *HTTPFetcher
+	chromeFetcher      *ChromeFetcher
+	stopReaper         chan struct{}
 	wg                 sync.WaitGroup
 }
 
@@ -110,7 +184,7 @@ func (c *Crawler) Init(config ...Settings) (err error) {
 		if err != nil {
 			return err
 		}
-		c.log.Info("saved settings: %v", config[0])
+		c.log.Infof("saved settings: %v", config[0])
 	}
 	// load the configuration from Redis
 	var val string
@@ -119,19 +193,28 @@ func (c *Crawler) Init(config ...Settings) (err error) {
 		return errors.New(fmt.Sprintf("You need to set the base settings. Use\n\n\tcrawdad -s %s -p %s -set -url http://www.URL.com\n\n", c.RedisURL, c.RedisPort))
 	}
 	err = json.Unmarshal([]byte(val), &c.Settings)
-	c.log.Info("loaded settings: %v", c.Settings)
+	c.log.Infof("loaded settings: %v", c.Settings)
+	if c.Settings.LeaseTimeout == 0 {
+		c.Settings.LeaseTimeout = 30 * time.Second
+	}
+	if c.Settings.MaxAttempts == 0 {
+		c.Settings.MaxAttempts = 3
+	}
+	if c.Settings.SimHashThreshold == 0 {
+		c.Settings.SimHashThreshold = 3
+	}
 
 	// Generate the connection pool
 	var tr *http.Transport
 	if c.UseProxy {
 		tbProxyURL, err := url.Parse("socks5://127.0.0.1:9050")
 		if err != nil {
-			c.log.Fatal("Failed to parse proxy URL: %v\n", err)
+			c.log.Fatalf("Failed to parse proxy URL: %v\n", err)
 			return err
 		}
 		tbDialer, err := proxy.FromURL(tbProxyURL, proxy.Direct)
 		if err != nil {
-			c.log.Fatal("Failed to obtain proxy dialer: %v\n", err)
+			c.log.Fatalf("Failed to obtain proxy dialer: %v\n", err)
 			return err
 		}
 		tr = &http.Transport{
@@ -152,45 +235,54 @@ func (c *Crawler) Init(config ...Settings) (err error) {
 		Timeout:   time.Duration(10 * time.Second),
 	}
 
-	// Setup Redis client
-	c.todo = redis.NewClient(&redis.Options{
-		Addr:        c.RedisURL + ":" + c.RedisPort,
-		Password:    "", // no password set
-		DB:          0,  // use default DB
-		ReadTimeout: 30 * time.Second,
-		MaxRetries:  10,
-	})
-	c.doing = redis.NewClient(&redis.Options{
-		Addr:        c.RedisURL + ":" + c.RedisPort,
-		Password:    "", // no password set
-		DB:          1,  // use default DB
-		ReadTimeout: 30 * time.Second,
-		MaxRetries:  10,
-	})
-	c.done = redis.NewClient(&redis.Options{
+	c.httpFetcher = &HTTPFetcher{Client: c.client, UserAgent: c.UserAgent}
+	c.chromeFetcher = &ChromeFetcher{
+		WaitFor:            c.Settings.ChromeWaitFor,
+		NetworkIdleTimeout: c.Settings.ChromeNetworkIdleTimeout,
+		UserAgent:          c.UserAgent,
+	}
+
+	// Setup the leased 'todo'/'doing' job queue and the 'done'/'trash'
+	// queues on whichever backend was requested in Settings.QueueBackend
+	// ("redis" if unset)
+	if c.jobs, err = c.newJobsQueue(); err != nil {
+		return err
+	}
+	if c.done, err = c.newQueue("done", 2); err != nil {
+		return err
+	}
+	if c.trash, err = c.newQueue("trash", 3); err != nil {
+		return err
+	}
+
+	c.robots = redis.NewClient(&redis.Options{
 		Addr:        c.RedisURL + ":" + c.RedisPort,
 		Password:    "", // no password set
-		DB:          2,  // use default DB
+		DB:          5,  // use default DB
 		ReadTimeout: 30 * time.Second,
 		MaxRetries:  10,
 	})
-	c.trash = redis.NewClient(&redis.Options{
+
+	c.dedup = redis.NewClient(&redis.Options{
 		Addr:        c.RedisURL + ":" + c.RedisPort,
 		Password:    "", // no password set
-		DB:          3,  // use default DB
+		DB:          6,
 		ReadTimeout: 30 * time.Second,
 		MaxRetries:  10,
 	})
 
 	if c.EraseDB {
-		c.log.Info("Flushed database")
+		c.log.Infof("Flushed database")
 		err = c.Flush()
 		if err != nil {
 			return err
 		}
 	}
+	c.stopReaper = make(chan struct{})
+	go c.reapExpiredLeases()
+	c.serveMetrics(c.Settings.MetricsAddr)
 	if len(c.Settings.BaseURL) > 0 {
-		c.log.Info("Adding %s to URLs", c.Settings.BaseURL)
+		c.log.Infof("Adding %s to URLs", c.Settings.BaseURL)
 		err = c.AddSeeds([]string{c.Settings.BaseURL})
 		if err != nil {
 			return err
@@ -199,84 +291,157 @@ func (c *Crawler) Init(config ...Settings) (err error) {
 	return
 }
 
-func (c *Crawler) Logging() {
-	// Generate the logging
-	if c.Info {
-		c.log = lumber.NewConsoleLogger(lumber.INFO)
-	} else if c.Debug {
-		c.log = lumber.NewConsoleLogger(lumber.TRACE)
-	} else {
-		c.log = lumber.NewConsoleLogger(lumber.WARN)
+// newQueue builds the Queue for one of the "done"/"trash" lists, using
+// whichever backend Settings.QueueBackend names. index is the Redis DB
+// index the plain "redis" backend has always used for that list, kept
+// for backwards compatibility.
+func (c *Crawler) newQueue(name string, index int) (queue.Queue, error) {
+	switch c.Settings.QueueBackend {
+	case "", "redis":
+		return queue.NewRedis(c.RedisURL+":"+c.RedisPort, "", index)
+	case "sentinel":
+		cs, err := queue.ParseConnStr(c.Settings.QueueConnStr)
+		if err != nil {
+			return nil, errors.Wrap(err, "bad QueueConnStr")
+		}
+		// Namespace by key prefix rather than DB index: a Cluster has
+		// no SELECT, so index would silently collapse "done" and
+		// "trash" into one keyspace there.
+		return queue.NewSentinel(cs, name)
+	case "bolt":
+		boltPath := c.BoltPath
+		if boltPath == "" {
+			boltPath = "crawdad.db"
+		}
+		// one file per list: BoltDB holds an exclusive file lock, so
+		// "done" and "trash" can't both open the same file in-process
+		return queue.NewBolt(boltPath+"."+name, name)
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown QueueBackend %q", c.Settings.QueueBackend))
 	}
 }
 
-func (c *Crawler) Redo() (err error) {
-	var keys []string
-	keys, err = c.doing.Keys("*").Result()
-	if err != nil {
-		return
-	}
-	for _, key := range keys {
-		c.log.Trace("Moving %s back to todo list", key)
-		_, err = c.doing.Del(key).Result()
+// newJobsQueue builds the leased todo/doing job queue on whichever backend
+// Settings.QueueBackend names. The "redis" backend puts it in DB 0 (the old
+// 'todo' index) and "sentinel" in QueueConnStr's db (or a Cluster's single
+// keyspace), namespacing its own keys under "crawdad:jobs" either way.
+func (c *Crawler) newJobsQueue() (queue.LeaseQueue, error) {
+	switch c.Settings.QueueBackend {
+	case "", "redis":
+		return queue.NewRedisLease(c.RedisURL+":"+c.RedisPort, "", 0, "crawdad:jobs")
+	case "sentinel":
+		cs, err := queue.ParseConnStr(c.Settings.QueueConnStr)
 		if err != nil {
-			c.log.Error(err.Error())
-		}
-		_, err = c.todo.Set(key, "", 0).Result()
-		if err != nil {
-			c.log.Error(err.Error())
-		}
+			return nil, errors.Wrap(err, "bad QueueConnStr")
+		}
+		if cs.Master != "" {
+			failover := redis.NewFailoverClient(&redis.FailoverOptions{
+				MasterName:    cs.Master,
+				SentinelAddrs: cs.Addrs,
+				Password:      cs.Password,
+				DB:            cs.DB,
+			})
+			if _, err := failover.Ping().Result(); err != nil {
+				return nil, err
+			}
+			return queue.NewRedisLeaseFromClient(failover, "crawdad:jobs"), nil
+		}
+		// Cluster mode: every key the leasing scripts touch is hash-tagged
+		// under "{crawdad:jobs}" so they all land on the same slot, which
+		// is what lets a multi-key Lua script run on a Cluster at all.
+		cluster := redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:    cs.Addrs,
+			Password: cs.Password,
+		})
+		if _, err := cluster.Ping().Result(); err != nil {
+			return nil, err
+		}
+		return queue.NewRedisLeaseFromClient(cluster, "{crawdad:jobs}"), nil
+	case "bolt":
+		boltPath := c.BoltPath
+		if boltPath == "" {
+			boltPath = "crawdad.db"
+		}
+		// a separate file from the done/trash BoltQueues' files, since
+		// BoltDB holds an exclusive file lock and all are opened in-process
+		return queue.NewBoltLease(boltPath + ".jobs")
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown QueueBackend %q", c.Settings.QueueBackend))
 	}
+}
 
-	keys, err = c.trash.Keys("*").Result()
+// Logging sets up c's structured (JSON) logger, so output from many
+// distributed crawdad workers can be aggregated the same way.
+func (c *Crawler) Logging() {
+	level := zap.WarnLevel
+	if c.Debug {
+		level = zap.DebugLevel
+	} else if c.Info {
+		level = zap.InfoLevel
+	}
+	cfg := zap.NewProductionConfig()
+	cfg.Level = zap.NewAtomicLevelAt(level)
+	logger, err := cfg.Build()
 	if err != nil {
-		return
+		logger = zap.NewNop()
 	}
-	for _, key := range keys {
-		c.log.Trace("Moving %s back to todo list", key)
-		_, err = c.trash.Del(key).Result()
-		if err != nil {
-			c.log.Error(err.Error())
-		}
-		_, err = c.todo.Set(key, "", 0).Result()
-		if err != nil {
-			c.log.Error(err.Error())
-		}
+	c.log = logger.Sugar()
+}
+
+// Redo reclaims any leased-but-unfinished URLs. It's now just a manual
+// trigger for the same reclaim the background reaper runs continuously;
+// kept for callers that want to force it (e.g. right before shutdown).
+func (c *Crawler) Redo() (err error) {
+	n, err := c.jobs.ReapExpired()
+	if err != nil {
+		return err
 	}
+	c.log.Debugf("Reclaimed %d leased URLs", n)
+	return nil
+}
 
-	return
+// reapExpiredLeases runs until Init's stopReaper channel is closed,
+// periodically returning expired leases to the ready queue so a crashed
+// worker can't strand a URL in 'doing' forever.
+func (c *Crawler) reapExpiredLeases() {
+	ticker := time.NewTicker(c.Settings.LeaseTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n, err := c.jobs.ReapExpired()
+			if err != nil {
+				c.log.Errorf("Problem reaping expired leases: %s", err.Error())
+				continue
+			}
+			if n > 0 {
+				c.log.Debugf("Reaper reclaimed %d leased URLs", n)
+			}
+		case <-c.stopReaper:
+			return
+		}
+	}
 }
 
 func (c *Crawler) DumpMap() (m map[string]string, err error) {
 	fmt.Println("Dumping...")
-	totalSize := int64(0)
-	var tempSize int64
-	tempSize, _ = c.done.DbSize().Result()
-	totalSize = tempSize * 2
-	bar := pb.StartNew(int(totalSize))
+	var doneSize int64
+	doneSize, _ = c.done.Size()
+	bar := pb.StartNew(int(doneSize * 2))
 	defer bar.Finish()
 
-	var keySize int64
 	var keys []string
-	keySize, _ = c.done.DbSize().Result()
-	keys = make([]string, keySize+10000)
-	i := 0
-	iter := c.done.Scan(0, "", 0).Iterator()
-	for iter.Next() {
-		bar.Increment()
-		keys[i] = iter.Val()
-		i++
-	}
-	keys = keys[:i]
-	if err = iter.Err(); err != nil {
-		c.log.Error("Problem getting done")
+	keys, err = c.done.Scan()
+	if err != nil {
+		c.log.Errorf("Problem getting done")
 		return
 	}
+	bar.Add(len(keys))
 	m = make(map[string]string)
 	for _, key := range keys {
 		bar.Increment()
 		var val string
-		val, err = c.done.Get(key).Result()
+		val, err = c.done.Get(key)
 		if err != nil {
 			return
 		}
@@ -288,92 +453,51 @@ func (c *Crawler) DumpMap() (m map[string]string, err error) {
 func (c *Crawler) Dump() (allKeys []string, err error) {
 	fmt.Println("Dumping...")
 	allKeys = make([]string, 0)
-	var keySize int64
-	var keys []string
 
-	totalSize := int64(0)
-	var tempSize int64
-	tempSize, _ = c.todo.DbSize().Result()
-	totalSize += tempSize
-	tempSize, _ = c.done.DbSize().Result()
-	totalSize += tempSize
-	tempSize, _ = c.doing.DbSize().Result()
-	totalSize += tempSize
-	tempSize, _ = c.trash.DbSize().Result()
-	totalSize += tempSize
-	bar := pb.StartNew(int(totalSize))
+	todoSize, _ := c.jobs.ReadySize()
+	doingSize, _ := c.jobs.LeasedSize()
+	doneSize, _ := c.done.Size()
+	trashSize, _ := c.trash.Size()
+	bar := pb.StartNew(int(todoSize + doingSize + doneSize + trashSize))
 	defer bar.Finish()
 
-	keySize, _ = c.todo.DbSize().Result()
-	keys = make([]string, keySize)
-	i := 0
-	iter := c.todo.Scan(0, "", 0).Iterator()
-	for iter.Next() {
-		bar.Increment()
-		keys[i] = iter.Val()
-		i++
-	}
-	if err := iter.Err(); err != nil {
-		c.log.Error("Problem getting todo")
-		return nil, err
-	}
-	allKeys = append(allKeys, keys...)
-
-	keySize, _ = c.doing.DbSize().Result()
-	keys = make([]string, keySize)
-	i = 0
-	iter = c.doing.Scan(0, "", 0).Iterator()
-	for iter.Next() {
-		bar.Increment()
-		keys[i] = iter.Val()
-		i++
-	}
-	if err := iter.Err(); err != nil {
-		c.log.Error("Problem getting doing")
-		return nil, err
-	}
-	allKeys = append(allKeys, keys...)
-
-	keySize, _ = c.done.DbSize().Result()
-	keys = make([]string, keySize)
-	i = 0
-	iter = c.done.Scan(0, "", 0).Iterator()
-	for iter.Next() {
-		bar.Increment()
-		keys[i] = iter.Val()
-		i++
-	}
-	if err := iter.Err(); err != nil {
-		c.log.Error("Problem getting done")
+	todoKeys, err := c.jobs.Scan()
+	if err != nil {
+		c.log.Errorf("Problem getting todo")
 		return nil, err
 	}
-	allKeys = append(allKeys, keys...)
+	bar.Add(len(todoKeys))
+	allKeys = append(allKeys, todoKeys...)
+	// leased ("doing") keys aren't individually enumerable across
+	// backends, so they're only reflected in the progress bar above
 
-	keySize, _ = c.trash.DbSize().Result()
-	keys = make([]string, keySize)
-	i = 0
-	iter = c.trash.Scan(0, "", 0).Iterator()
-	for iter.Next() {
-		bar.Increment()
-		keys[i] = iter.Val()
-		i++
+	lists := []struct {
+		name string
+		q    queue.Queue
+	}{
+		{"done", c.done},
+		{"trash", c.trash},
 	}
-	if err := iter.Err(); err != nil {
-		c.log.Error("Problem getting trash")
-		return nil, err
+	for _, list := range lists {
+		keys, scanErr := list.q.Scan()
+		if scanErr != nil {
+			c.log.Errorf("Problem getting %s", list.name)
+			return nil, scanErr
+		}
+		bar.Add(len(keys))
+		allKeys = append(allKeys, keys...)
 	}
-	allKeys = append(allKeys, keys...)
 	return
 }
 
 func (c *Crawler) getIP() (ip string, err error) {
 	req, err := http.NewRequest("GET", "http://icanhazip.com", nil)
 	if err != nil {
-		c.log.Error("Problem making request")
+		c.log.Errorf("Problem making request")
 		return
 	}
 	if c.UserAgent != "" {
-		c.log.Trace("Setting useragent string to '%s'", c.UserAgent)
+		c.log.Debugf("Setting useragent string to '%s'", c.UserAgent)
 		req.Header.Set("User-Agent", c.UserAgent)
 	}
 	resp, err := c.client.Do(req)
@@ -393,87 +517,143 @@ func (c *Crawler) getIP() (ip string, err error) {
 func (c *Crawler) addLinkToDo(link string, force bool) (err error) {
 	if !force {
 		// add only if it isn't already in one of the databases
-		_, err = c.todo.Get(link).Result()
-		if err != redis.Nil {
+		var has bool
+		has, err = c.jobs.Has(link)
+		if err != nil || has {
 			return
 		}
-		_, err = c.doing.Get(link).Result()
-		if err != redis.Nil {
+		_, err = c.done.Get(link)
+		if err != queue.ErrNotFound {
 			return
 		}
-		_, err = c.done.Get(link).Result()
-		if err != redis.Nil {
+		_, err = c.trash.Get(link)
+		if err != queue.ErrNotFound {
 			return
 		}
-		_, err = c.trash.Get(link).Result()
-		if err != redis.Nil {
-			return
+	}
+
+	// honor the host's Crawl-delay, if any, by not making the link
+	// eligible for Lease until its reserved fetch slot arrives
+	var readyAt time.Time
+	if c.Settings.RespectRobots {
+		if host, hostErr := hostOf(link); hostErr == nil {
+			readyAt, err = c.crawlDelayReadyAt(host)
+			if err != nil {
+				c.log.Errorf("Problem checking crawl-delay for %s: %s", host, err.Error())
+				err = nil
+			}
 		}
 	}
 
 	// add it to the todo list
-	err = c.todo.Set(link, "", 0).Err()
+	err = c.jobs.AddDelayed(link, "", readyAt)
 	return
 }
 
 // Flush erases the database
 func (c *Crawler) Flush() (err error) {
-	_, err = c.todo.FlushAll().Result()
+	err = c.jobs.Flush()
 	if err != nil {
 		return
 	}
-	_, err = c.done.FlushAll().Result()
+	err = c.done.Flush()
 	if err != nil {
 		return
 	}
-	_, err = c.doing.FlushAll().Result()
-	if err != nil {
-		return
-	}
-	_, err = c.trash.FlushAll().Result()
+	err = c.trash.Flush()
 	if err != nil {
 		return
 	}
 	return
 }
 
-func (c *Crawler) scrapeLinks(url string) (linkCandidates []string, pluckedData string, err error) {
-	c.log.Trace("Scraping %s", url)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		c.log.Error("Problem making request for %s: %s", url, err.Error())
-		return nil, "", nil
-	}
-	if c.UserAgent != "" {
-		c.log.Trace("Setting useragent string to '%s'", c.UserAgent)
-		req.Header.Set("User-Agent", c.UserAgent)
+// errDeferred signals that a URL was intentionally not fetched (e.g. the
+// per-host rate limit bucket is empty) and should be returned to 'todo'
+// instead of being trashed.
+var errDeferred = errors.New("deferred")
+
+// errDisallowed signals that a URL is blocked by the host's robots.txt.
+var errDisallowed = errors.New("disallowed by robots.txt")
+
+// errFetchFailed signals a failed fetch (a transport error or a non-200
+// response); the job should be retried
+// (and eventually dead-lettered) rather than treated as a hard error.
+var errFetchFailed = errors.New("fetch failed")
+
+func (c *Crawler) scrapeLinks(workerID int, rawurl string) (linkCandidates []string, pluckedData string, dup *dupResult, body []byte, err error) {
+	c.log.Debugf("Scraping %s", rawurl)
+	fetchStart := time.Now()
+
+	if c.Settings.RespectRobots || c.Settings.PerHostQPS > 0 {
+		host, hostErr := hostOf(rawurl)
+		if hostErr == nil {
+			if c.Settings.RespectRobots {
+				var allowed bool
+				allowed, err = c.robotsAllowed(host, rawurl)
+				if err != nil {
+					c.log.Errorf("Problem checking robots.txt for %s: %s", host, err.Error())
+					err = nil
+				} else if !allowed {
+					return nil, "", nil, nil, errDisallowed
+				}
+			}
+			if c.Settings.PerHostQPS > 0 {
+				var ok bool
+				ok, err = c.allowHost(host)
+				if err != nil {
+					c.log.Errorf("Problem checking rate limit for %s: %s", host, err.Error())
+					err = nil
+				} else if !ok {
+					return nil, "", nil, nil, errDeferred
+				}
+			}
+		}
 	}
-	resp, err := c.client.Do(req)
+
+	resp, err := c.fetcherFor(rawurl).Fetch(context.Background(), rawurl)
+	duration := time.Since(fetchStart)
+	metricsFetchDuration.Observe(duration.Seconds())
 	if err != nil {
-		c.log.Error("Problem doing request for %s: %s", url, err.Error())
-		return nil, "", nil
+		c.log.Errorf("Problem fetching %s: %s", rawurl, err.Error())
+		c.errors++
+		if c.errors > int64(c.MaximumNumberOfErrors) {
+			err = errors.New("too many errors!")
+			return
+		}
+		err = errFetchFailed
+		return
 	}
-	defer resp.Body.Close()
+	metricsHTTPStatus.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
+	c.log.Infow("fetched url",
+		"worker_id", workerID,
+		"url", rawurl,
+		"status", resp.StatusCode,
+		"duration_ms", duration.Milliseconds(),
+		"bytes", len(resp.Body),
+	)
 
 	if resp.StatusCode != 200 {
-		c.doing.Del(url).Result()
-		c.todo.Del(url).Result()
-		c.trash.Set(url, "", 0).Result()
 		c.errors++
 		if c.errors > int64(c.MaximumNumberOfErrors) {
 			err = errors.New("too many errors!")
 			return
 		}
-		return
+		return nil, "", nil, nil, errFetchFailed
 	}
 
 	// reset errors as long as the code is good
 	c.errors = 0
 
-	// copy resp.Body
-	var bodyBytes []byte
-	bodyBytes, _ = ioutil.ReadAll(resp.Body)
-	resp.Body = ioutil.NopCloser(bytes.NewBuffer(bodyBytes))
+	bodyBytes := resp.Body
+	body = bodyBytes
+
+	if c.Settings.DedupContent {
+		dup, err = c.dedupCheck(rawurl, resp.Header.Get("Content-Location"), bodyBytes)
+		if err != nil {
+			c.log.Errorf("Problem checking dedup state for %s: %s", rawurl, err.Error())
+			dup, err = nil, nil
+		}
+	}
 
 	// do plucking
 	if c.Settings.PluckConfig != "" {
@@ -494,13 +674,13 @@ func (c *Crawler) scrapeLinks(url string) (linkCandidates []string, pluckedData
 	}
 
 	// collect links
-	links := collectlinks.All(resp.Body)
+	links := collectlinks.All(bytes.NewReader(bodyBytes))
 
 	// find good links
 	linkCandidates = make([]string, len(links))
 	linkCandidatesI := 0
 	for _, link := range links {
-		c.log.Trace(link)
+		c.log.Debugf("%s", link)
 		// disallow query parameters, if not flagged
 		if strings.Contains(link, "?") && !c.Settings.AllowQueryParameters {
 			link = strings.Split(link, "?")[0]
@@ -521,7 +701,7 @@ func (c *Crawler) scrapeLinks(url string) (linkCandidates []string, pluckedData
 
 		// skip links that have a different Base URL
 		if !strings.Contains(link, c.Settings.BaseURL) {
-			// c.log.Trace("Skipping %s because it has a different base URL", link)
+			// c.log.Debugf("Skipping %s because it has a different base URL", link)
 			continue
 		}
 
@@ -537,7 +717,7 @@ func (c *Crawler) scrapeLinks(url string) (linkCandidates []string, pluckedData
 		for _, keyword := range c.Settings.KeywordsToExclude {
 			if strings.Contains(normalizedLink, keyword) {
 				foundExcludedKeyword = true
-				// c.log.Trace("Skipping %s because contains %s", link, keyword)
+				// c.log.Debugf("Skipping %s because contains %s", link, keyword)
 				break
 			}
 		}
@@ -572,23 +752,65 @@ func (c *Crawler) crawl(id int, jobs <-chan string, results chan<- error) {
 		// time the link getting process
 		t := time.Now()
 
-		c.log.Trace("Got work in %s", time.Since(t).String())
-		urls, pluckedData, err := c.scrapeLinks(randomURL)
+		c.log.Debugf("Got work in %s", time.Since(t).String())
+		urls, pluckedData, dup, body, err := c.scrapeLinks(id, randomURL)
+		if err == errDeferred {
+			// host's rate limit bucket is empty; give it back to 'todo'
+			// without counting it as a failed attempt, so it gets
+			// retried later
+			c.log.Debugf("Deferring %s, rate limit reached", randomURL)
+			c.jobs.Release(randomURL)
+			results <- nil
+			continue
+		}
+		if err == errDisallowed {
+			c.log.Debugf("Skipping %s, disallowed by robots.txt", randomURL)
+			c.jobs.Ack(randomURL)
+			results <- nil
+			continue
+		}
+		if err == errFetchFailed {
+			deadLettered, nackErr := c.jobs.Nack(randomURL, c.Settings.MaxAttempts, c.trash)
+			if nackErr != nil {
+				results <- nackErr
+				continue
+			}
+			if deadLettered {
+				c.log.Debugf("Dead-lettered %s after %d attempts", randomURL, c.Settings.MaxAttempts)
+				metricsErrors.Inc()
+			} else {
+				c.log.Debugf("Retrying %s", randomURL)
+			}
+			results <- nil
+			continue
+		}
 		if err != nil {
+			metricsErrors.Inc()
 			results <- err
 			continue
 		}
 
 		t = time.Now()
 
-		// move url to 'done'
-		_, err = c.doing.Del(randomURL).Result()
+		// move url to 'done', under its canonical URL and with any
+		// near-duplicate verdict folded in, when dedup is enabled
+		doneKey, doneValue := randomURL, pluckedData
+		if dup != nil {
+			if dup.CanonicalURL != "" {
+				doneKey = dup.CanonicalURL
+			}
+			doneValue = dup.encode(pluckedData)
+		}
+		err = c.done.Add(doneKey, doneValue)
 		if err != nil {
 			results <- err
 			continue
 		}
-		_, err = c.done.Set(randomURL, pluckedData, 0).Result()
-		if err != nil {
+		metricsURLsFetched.Inc()
+		if c.stream != nil {
+			c.stream.record(Record{URL: doneKey, Plucked: pluckedData, FetchedAt: time.Now(), Body: body})
+		}
+		if err = c.jobs.Ack(randomURL); err != nil {
 			results <- err
 			continue
 		}
@@ -598,7 +820,7 @@ func (c *Crawler) crawl(id int, jobs <-chan string, results chan<- error) {
 			c.addLinkToDo(url, false)
 		}
 		if len(urls) > 0 {
-			c.log.Info("worker #%d: %d urls from %s [%s]", id, len(urls), randomURL, time.Since(t).String())
+			c.log.Infof("worker #%d: %d urls from %s [%s]", id, len(urls), randomURL, time.Since(t).String())
 		}
 		c.numberOfURLSParsed++
 		results <- nil
@@ -622,7 +844,7 @@ func (c *Crawler) AddSeeds(seeds []string) (err error) {
 			return
 		}
 	}
-	c.log.Info("Added %d seed links", len(seeds))
+	c.log.Infof("Added %d seed links", len(seeds))
 	return
 }
 
@@ -642,37 +864,36 @@ func (c *Crawler) Crawl() (err error) {
 	defer c.stopCrawling()
 	for {
 		// check if there are any links to do
-		dbsize, err := c.todo.DbSize().Result()
+		dbsize, err := c.jobs.ReadySize()
+		if err != nil {
+			return err
+		}
+		doingSize, err := c.jobs.LeasedSize()
 		if err != nil {
 			return err
 		}
 
-		// break if there are no links to do
-		if dbsize == 0 {
-			c.log.Info("No more work to do!")
+		// break if there's no work ready and nothing left to be reaped
+		if dbsize == 0 && doingSize == 0 {
+			c.log.Infof("No more work to do!")
 			break
 		}
+		if dbsize == 0 {
+			// everything ready is leased out to other workers; wait for
+			// the reaper to reclaim any expired leases
+			time.Sleep(time.Second)
+			continue
+		}
 
 		urlsToDo := make([]string, c.MaxNumberWorkers)
 		maxI := 0
 		for i := 0; i < c.MaxNumberWorkers; i++ {
-			randomURL, err := c.todo.RandomKey().Result()
+			randomURL, _, _, err := c.jobs.Lease(fmt.Sprintf("worker-%d", i), c.Settings.LeaseTimeout)
 			if err != nil {
 				continue
 			}
 			urlsToDo[i] = randomURL
 			maxI = i
-
-			// place in 'doing'
-			_, err = c.todo.Del(randomURL).Result()
-			if err != nil {
-				return errors.Wrap(err, "problem removing from todo")
-			}
-			_, err = c.doing.Set(randomURL, "", 0).Result()
-			if err != nil {
-				return errors.Wrap(err, "problem placing in doing")
-			}
-
 		}
 		urlsToDo = urlsToDo[:maxI+1]
 
@@ -700,6 +921,10 @@ func (c *Crawler) Crawl() (err error) {
 func (c *Crawler) stopCrawling() {
 	c.isRunning = false
 	c.printStats()
+	if c.stream != nil {
+		c.stream.close()
+	}
+	c.chromeFetcher.Close()
 }
 
 func round(f float64) int {
@@ -711,54 +936,55 @@ func round(f float64) int {
 
 func (c *Crawler) updateListCounts() (err error) {
 	// Update stats
-	c.numToDo, err = c.todo.DbSize().Result()
+	c.numToDo, err = c.jobs.ReadySize()
 	if err != nil {
 		return
 	}
-	c.numDoing, err = c.doing.DbSize().Result()
+	c.numDoing, err = c.jobs.LeasedSize()
 	if err != nil {
 		return
 	}
-	c.numDone, err = c.done.DbSize().Result()
+	c.numDone, err = c.done.Size()
 	if err != nil {
 		return
 	}
-	c.numTrash, err = c.trash.DbSize().Result()
+	c.numTrash, err = c.trash.Size()
 	if err != nil {
 		return
 	}
+	metricsQueueSize.WithLabelValues("todo").Set(float64(c.numToDo))
+	metricsQueueSize.WithLabelValues("doing").Set(float64(c.numDoing))
+	metricsQueueSize.WithLabelValues("done").Set(float64(c.numDone))
+	metricsQueueSize.WithLabelValues("trash").Set(float64(c.numTrash))
 	return nil
 }
 
 func (c *Crawler) contantlyPrintStats() {
 	c.isRunning = true
-	fmt.Println(`                                           parsed speed   todo     done     doing   trash      errors
-                                                (urls/min)`)
 	for {
 		time.Sleep(time.Duration(int32(c.TimeIntervalToPrintStats)) * time.Second)
 		c.updateListCounts()
 		c.printStats()
 		if !c.isRunning {
-			fmt.Println("Finished")
+			c.log.Infof("Finished")
 			return
 		}
 	}
 }
 
+// printStats logs a snapshot of crawl progress; Settings.MetricsAddr is
+// the better way to watch a running crawl, since it exposes the same
+// numbers (plus fetch latency and status breakdowns) to Prometheus.
 func (c *Crawler) printStats() {
 	URLSPerSecond := round(60.0 * float64(c.numberOfURLSParsed) / float64(time.Since(c.programTime).Seconds()))
-	printURL := strings.Replace(c.Settings.BaseURL, "https://", "", 1)
-	printURL = strings.Replace(printURL, "http://", "", 1)
-	if len(printURL) > 17 {
-		printURL = printURL[:17]
-	}
-	log.Printf("[%17s] %9s %3d %8s %8s %8s %8s %8s\n",
-		printURL,
-		humanize.Comma(int64(c.numberOfURLSParsed)),
-		URLSPerSecond,
-		humanize.Comma(int64(c.numToDo)),
-		humanize.Comma(int64(c.numDone)),
-		humanize.Comma(int64(c.numDoing)),
-		humanize.Comma(int64(c.numTrash)),
-		humanize.Comma(int64(c.errors)))
+	c.log.Infow("crawl stats",
+		"base_url", c.Settings.BaseURL,
+		"parsed", c.numberOfURLSParsed,
+		"urls_per_min", URLSPerSecond,
+		"todo", c.numToDo,
+		"done", c.numDone,
+		"doing", c.numDoing,
+		"trash", c.numTrash,
+		"errors", c.errors,
+	)
 }
@@ -0,0 +1,294 @@
+package crawdad
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math/bits"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/go-redis/redis"
+	"golang.org/x/net/html"
+)
+
+// shingleSize is the number of words grouped into a single SimHash token.
+const shingleSize = 3
+
+// dupResult carries the canonicalization and near-duplicate verdict
+// scrapeLinks computed for a fetched page. It's nil whenever
+// Settings.DedupContent is off.
+type dupResult struct {
+	// CanonicalURL is the page's canonical URL, per its <link
+	// rel="canonical"> tag or Content-Location header, resolved against
+	// the crawled URL. The crawled URL itself if neither was present.
+	CanonicalURL string
+	// SimHash is the 64-bit fingerprint of the page's visible text.
+	SimHash uint64
+	// NearDuplicateOf is the canonical URL of a prior page whose SimHash
+	// is within Settings.SimHashThreshold of this one's, or "" if none
+	// was found.
+	NearDuplicateOf string
+}
+
+// doneRecord is the JSON shape stored in 'done' for a page once dedup is
+// enabled, so DumpMap's plucked data and near-duplicate verdict travel
+// together.
+type doneRecord struct {
+	Plucked         string `json:"plucked"`
+	SimHash         uint64 `json:"simhash,omitempty"`
+	NearDuplicateOf string `json:"near_duplicate_of,omitempty"`
+}
+
+// encode folds pluckedData and dup's near-duplicate verdict into the
+// value crawl() stores in 'done'.
+func (dup *dupResult) encode(pluckedData string) string {
+	b, err := json.Marshal(doneRecord{
+		Plucked:         pluckedData,
+		SimHash:         dup.SimHash,
+		NearDuplicateOf: dup.NearDuplicateOf,
+	})
+	if err != nil {
+		return pluckedData
+	}
+	return string(b)
+}
+
+// dedupCheck canonicalizes rawurl against contentLocation and any <link
+// rel="canonical"> found in body, fingerprints body's visible text with
+// SimHash, and checks that fingerprint against every previously indexed
+// page's, indexing it in turn for future lookups.
+func (c *Crawler) dedupCheck(rawurl, contentLocation string, body []byte) (*dupResult, error) {
+	dup := &dupResult{
+		CanonicalURL: canonicalURL(rawurl, contentLocation, body),
+		SimHash:      simhash64(extractVisibleText(body)),
+	}
+	key := dup.CanonicalURL
+	if key == "" {
+		key = rawurl
+	}
+	nearDuplicateOf, err := c.findAndIndexNearDuplicate(key, dup.SimHash)
+	if err != nil {
+		return nil, err
+	}
+	dup.NearDuplicateOf = nearDuplicateOf
+	return dup, nil
+}
+
+// findAndIndexNearDuplicate looks up prior fingerprints sharing a band
+// with hash, reports the first one within Settings.SimHashThreshold, and
+// then indexes key/hash so later pages can be compared against it too.
+func (c *Crawler) findAndIndexNearDuplicate(key string, hash uint64) (nearDuplicateOf string, err error) {
+	bands := simhashBands(hash)
+
+	candidates := make(map[string]bool)
+	for i, band := range bands {
+		members, bandErr := c.dedup.SMembers(bandKey(i, band)).Result()
+		if bandErr != nil && bandErr != redis.Nil {
+			return "", bandErr
+		}
+		for _, member := range members {
+			if member != key {
+				candidates[member] = true
+			}
+		}
+	}
+	for candidate := range candidates {
+		hex, getErr := c.dedup.Get(hashKey(candidate)).Result()
+		if getErr != nil {
+			continue
+		}
+		candidateHash, parseErr := strconv.ParseUint(hex, 16, 64)
+		if parseErr != nil {
+			continue
+		}
+		if hammingDistance(hash, candidateHash) <= c.Settings.SimHashThreshold {
+			nearDuplicateOf = candidate
+			break
+		}
+	}
+
+	if err = c.dedup.Set(hashKey(key), fmt.Sprintf("%016x", hash), 0).Err(); err != nil {
+		return nearDuplicateOf, err
+	}
+	for i, band := range bands {
+		if err = c.dedup.SAdd(bandKey(i, band), key).Err(); err != nil {
+			return nearDuplicateOf, err
+		}
+	}
+	return nearDuplicateOf, nil
+}
+
+func hashKey(key string) string {
+	return "simhash:hash:" + key
+}
+
+func bandKey(band int, value uint16) string {
+	return fmt.Sprintf("simhash:band:%d:%04x", band, value)
+}
+
+// canonicalURL resolves the canonical form of a fetched page: a
+// Content-Location response header takes precedence, then an HTML <link
+// rel="canonical"> tag; rawurl is returned if neither is present or
+// resolvable.
+func canonicalURL(rawurl, contentLocation string, body []byte) string {
+	if contentLocation != "" {
+		if resolved, err := resolveReference(rawurl, contentLocation); err == nil {
+			return resolved
+		}
+	}
+	if href := findCanonicalLink(body); href != "" {
+		if resolved, err := resolveReference(rawurl, href); err == nil {
+			return resolved
+		}
+	}
+	return rawurl
+}
+
+func resolveReference(rawurl, ref string) (string, error) {
+	base, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	refURL, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(refURL).String(), nil
+}
+
+// findCanonicalLink returns the href of body's <link rel="canonical">
+// tag, or "" if it has none.
+func findCanonicalLink(body []byte) string {
+	tokenizer := html.NewTokenizer(strings.NewReader(string(body)))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return ""
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			if token.Data != "link" {
+				continue
+			}
+			isCanonical, href := false, ""
+			for _, attr := range token.Attr {
+				switch attr.Key {
+				case "rel":
+					isCanonical = strings.ToLower(attr.Val) == "canonical"
+				case "href":
+					href = attr.Val
+				}
+			}
+			if isCanonical && href != "" {
+				return href
+			}
+		}
+	}
+}
+
+// extractVisibleText walks body's HTML, concatenating text nodes outside
+// <script>/<style> elements.
+func extractVisibleText(body []byte) string {
+	tokenizer := html.NewTokenizer(strings.NewReader(string(body)))
+	var sb strings.Builder
+	skipDepth := 0
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return sb.String()
+		case html.StartTagToken:
+			if tag := tokenizer.Token().Data; tag == "script" || tag == "style" {
+				skipDepth++
+			}
+		case html.EndTagToken:
+			if tag := tokenizer.Token().Data; tag == "script" || tag == "style" {
+				if skipDepth > 0 {
+					skipDepth--
+				}
+			}
+		case html.TextToken:
+			if skipDepth == 0 {
+				sb.Write(tokenizer.Text())
+				sb.WriteByte(' ')
+			}
+		}
+	}
+}
+
+// tokenize lowercases text and splits it into words.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// shingles groups tokens into overlapping runs of shingleSize words.
+func shingles(tokens []string) []string {
+	if len(tokens) == 0 {
+		return nil
+	}
+	if len(tokens) < shingleSize {
+		return []string{strings.Join(tokens, " ")}
+	}
+	out := make([]string, 0, len(tokens)-shingleSize+1)
+	for i := 0; i+shingleSize <= len(tokens); i++ {
+		out = append(out, strings.Join(tokens[i:i+shingleSize], " "))
+	}
+	return out
+}
+
+// simhash64 computes a 64-bit SimHash fingerprint over text's word
+// shingles: each distinct shingle's fnv64 hash votes its frequency
+// toward or against every bit position depending on whether that bit of
+// the hash is set, and the sign of the resulting sum becomes the
+// fingerprint's bit.
+func simhash64(text string) uint64 {
+	freq := make(map[string]int)
+	for _, shingle := range shingles(tokenize(text)) {
+		freq[shingle]++
+	}
+
+	var weights [64]int
+	for shingle, weight := range freq {
+		h := fnv64(shingle)
+		for bit := 0; bit < 64; bit++ {
+			if h&(1<<uint(bit)) != 0 {
+				weights[bit] += weight
+			} else {
+				weights[bit] -= weight
+			}
+		}
+	}
+
+	var fingerprint uint64
+	for bit := 0; bit < 64; bit++ {
+		if weights[bit] > 0 {
+			fingerprint |= 1 << uint(bit)
+		}
+	}
+	return fingerprint
+}
+
+func fnv64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+func hammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// simhashBands splits hash into 4 bands of 16 bits each, used to index
+// fingerprints in Redis for sub-linear near-duplicate candidate lookup:
+// two pages can only be found as candidates for each other if at least
+// one of their bands matches exactly.
+func simhashBands(hash uint64) [4]uint16 {
+	var bands [4]uint16
+	for i := 0; i < 4; i++ {
+		bands[i] = uint16(hash >> uint(i*16))
+	}
+	return bands
+}
@@ -0,0 +1,187 @@
+package crawdad
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []string
+	}{
+		{
+			name: "lowercases and splits on punctuation",
+			text: "Hello, World! It's 2024.",
+			want: []string{"hello", "world", "it", "s", "2024"},
+		},
+		{
+			name: "empty text yields no tokens",
+			text: "",
+			want: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tokenize(tt.text); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tokenize(%q) = %v, want %v", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShingles(t *testing.T) {
+	tests := []struct {
+		name   string
+		tokens []string
+		want   []string
+	}{
+		{
+			name:   "no tokens means no shingles",
+			tokens: nil,
+			want:   nil,
+		},
+		{
+			name:   "fewer tokens than shingleSize joins them all",
+			tokens: []string{"a", "b"},
+			want:   []string{"a b"},
+		},
+		{
+			name:   "overlapping runs of shingleSize words",
+			tokens: []string{"a", "b", "c", "d"},
+			want:   []string{"a b c", "b c d"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shingles(tt.tokens); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("shingles(%v) = %v, want %v", tt.tokens, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHammingDistance(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b uint64
+		want int
+	}{
+		{name: "identical hashes", a: 0xFF00, b: 0xFF00, want: 0},
+		{name: "single bit differs", a: 0b0001, b: 0b0000, want: 1},
+		{name: "all bits differ", a: 0, b: ^uint64(0), want: 64},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hammingDistance(tt.a, tt.b); got != tt.want {
+				t.Errorf("hammingDistance(%x, %x) = %d, want %d", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSimhash64NearDuplicatesAreCloserThanUnrelatedText(t *testing.T) {
+	original := simhash64("the quick brown fox jumps over the lazy dog every single morning")
+	nearDuplicate := simhash64("the quick brown fox jumps over the lazy dog every single afternoon")
+	unrelated := simhash64("quarterly earnings report shows revenue growth across all regions")
+
+	near := hammingDistance(original, nearDuplicate)
+	far := hammingDistance(original, unrelated)
+	if near >= far {
+		t.Errorf("hammingDistance(near-duplicate) = %d, hammingDistance(unrelated) = %d; want near-duplicate text clearly closer", near, far)
+	}
+}
+
+func TestSimhash64EmptyTextIsStable(t *testing.T) {
+	if got, want := simhash64(""), uint64(0); got != want {
+		t.Errorf("simhash64(\"\") = %x, want %x", got, want)
+	}
+}
+
+func TestCanonicalURL(t *testing.T) {
+	tests := []struct {
+		name            string
+		rawurl          string
+		contentLocation string
+		body            string
+		want            string
+	}{
+		{
+			name:   "no canonical hint falls back to rawurl",
+			rawurl: "https://example.com/page",
+			body:   "<html><body>hi</body></html>",
+			want:   "https://example.com/page",
+		},
+		{
+			name:   "link rel=canonical resolved against rawurl",
+			rawurl: "https://example.com/page?utm=1",
+			body:   `<html><head><link rel="canonical" href="/page"></head></html>`,
+			want:   "https://example.com/page",
+		},
+		{
+			name:            "Content-Location wins over link rel=canonical",
+			rawurl:          "https://example.com/page",
+			contentLocation: "/canonical-page",
+			body:            `<html><head><link rel="canonical" href="/other-page"></head></html>`,
+			want:            "https://example.com/canonical-page",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := canonicalURL(tt.rawurl, tt.contentLocation, []byte(tt.body))
+			if got != tt.want {
+				t.Errorf("canonicalURL(%q, %q, body) = %q, want %q", tt.rawurl, tt.contentLocation, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindCanonicalLink(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			name: "no link tag returns empty",
+			body: "<html><body>hi</body></html>",
+			want: "",
+		},
+		{
+			name: "link rel=canonical returns its href",
+			body: `<html><head><link rel="canonical" href="https://example.com/real"></head></html>`,
+			want: "https://example.com/real",
+		},
+		{
+			name: "link without rel=canonical is ignored",
+			body: `<html><head><link rel="stylesheet" href="/style.css"></head></html>`,
+			want: "",
+		},
+		{
+			name: "rel matching is case-insensitive",
+			body: `<html><head><link rel="Canonical" href="/real"></head></html>`,
+			want: "/real",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := findCanonicalLink([]byte(tt.body)); got != tt.want {
+				t.Errorf("findCanonicalLink(body) = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractVisibleTextExcludesScriptAndStyle(t *testing.T) {
+	body := `<html><head><style>.x{color:red}</style></head>` +
+		`<body><p>Hello world</p><script>alert('hi')</script></body></html>`
+	got := extractVisibleText([]byte(body))
+	if !strings.Contains(got, "Hello") || !strings.Contains(got, "world") {
+		t.Errorf("extractVisibleText = %q, want it to contain the visible text", got)
+	}
+	if strings.Contains(got, "alert") || strings.Contains(got, "color") {
+		t.Errorf("extractVisibleText = %q, want script/style content excluded", got)
+	}
+}
@@ -0,0 +1,71 @@
+package crawdad
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+)
+
+// Response is the result of a Fetcher fetching a single URL.
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// Fetcher retrieves a URL's content. scrapeLinks calls whichever one
+// Settings.Renderer (or a matching RendererOverride) selects, so JS-heavy
+// pages can be rendered by a real browser while the rest of a crawl stays
+// on cheap plain HTTP requests.
+type Fetcher interface {
+	Fetch(ctx context.Context, rawurl string) (*Response, error)
+}
+
+// HTTPFetcher fetches rawurl with a plain net/http GET. It's the
+// default Fetcher, and the only one used before Settings.Renderer
+// existed.
+type HTTPFetcher struct {
+	Client    *http.Client
+	UserAgent string
+}
+
+func (f *HTTPFetcher) Fetch(ctx context.Context, rawurl string) (*Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	if f.UserAgent != "" {
+		req.Header.Set("User-Agent", f.UserAgent)
+	}
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &Response{StatusCode: resp.StatusCode, Header: resp.Header, Body: body}, nil
+}
+
+// fetcherFor picks the Fetcher rawurl should be fetched with: the first
+// RendererOverride whose Pattern matches rawurl's path wins, falling
+// back to Settings.Renderer ("http" if unset).
+func (c *Crawler) fetcherFor(rawurl string) Fetcher {
+	renderer := c.Settings.Renderer
+	if u, err := url.Parse(rawurl); err == nil {
+		for _, o := range c.Settings.RendererOverrides {
+			if matched, matchErr := path.Match(o.Pattern, u.Path); matchErr == nil && matched {
+				renderer = o.Renderer
+				break
+			}
+		}
+	}
+	if renderer == "chrome" {
+		return c.chromeFetcher
+	}
+	return c.httpFetcher
+}
@@ -0,0 +1,48 @@
+package crawdad
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricsURLsFetched = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "crawdad_urls_fetched_total",
+		Help: "Total number of URLs successfully fetched and marked done.",
+	})
+	metricsQueueSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "crawdad_queue_size",
+		Help: "Number of URLs in each queue state.",
+	}, []string{"state"})
+	metricsFetchDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "crawdad_fetch_duration_seconds",
+		Help: "Time spent fetching a single URL.",
+	})
+	metricsHTTPStatus = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "crawdad_http_status_total",
+		Help: "Count of fetch responses by HTTP status code.",
+	}, []string{"code"})
+	metricsErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "crawdad_errors_total",
+		Help: "Total number of URLs that ended in a hard error.",
+	})
+)
+
+// serveMetrics exposes Prometheus metrics on addr at /metrics in the
+// background. It's a no-op when addr is empty, so metrics stay off by
+// default.
+func (c *Crawler) serveMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			c.log.Errorf("metrics server stopped: %s", err.Error())
+		}
+	}()
+}
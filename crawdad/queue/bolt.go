@@ -0,0 +1,88 @@
+package queue
+
+import (
+	"github.com/boltdb/bolt"
+)
+
+// BoltQueue is a Queue backed by an embedded BoltDB bucket, for single-node
+// crawls that don't want a Redis dependency at all.
+type BoltQueue struct {
+	db     *bolt.DB
+	bucket []byte
+}
+
+// NewBolt opens (creating if necessary) bucket in the BoltDB file at path.
+func NewBolt(path, bucket string) (*BoltQueue, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	q := &BoltQueue{db: db, bucket: []byte(bucket)}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(q.bucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *BoltQueue) Add(key, value string) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(q.bucket).Put([]byte(key), []byte(value))
+	})
+}
+
+func (q *BoltQueue) Get(key string) (value string, err error) {
+	err = q.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(q.bucket).Get([]byte(key))
+		if v == nil {
+			return ErrNotFound
+		}
+		value = string(v)
+		return nil
+	})
+	return
+}
+
+func (q *BoltQueue) Del(key string) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(q.bucket).Delete([]byte(key))
+	})
+}
+
+func (q *BoltQueue) Size() (int64, error) {
+	var n int64
+	err := q.db.View(func(tx *bolt.Tx) error {
+		n = int64(tx.Bucket(q.bucket).Stats().KeyN)
+		return nil
+	})
+	return n, err
+}
+
+func (q *BoltQueue) Scan() ([]string, error) {
+	var keys []string
+	err := q.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(q.bucket).ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	return keys, err
+}
+
+func (q *BoltQueue) Flush() error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(q.bucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(q.bucket)
+		return err
+	})
+}
+
+func (q *BoltQueue) Close() error {
+	return q.db.Close()
+}
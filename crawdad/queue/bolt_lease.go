@@ -0,0 +1,295 @@
+package queue
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// BoltLeaseQueue is a LeaseQueue backed by an embedded BoltDB file, for
+// single-node, zero-dependency crawls. Unlike RedisLeaseQueue it can't
+// coordinate leases across machines, but ready and leased state both
+// live in BoltDB buckets rather than in-process maps, so a process
+// restart with QueueBackend=bolt doesn't lose the todo/doing queue any
+// more than a restart with QueueBackend=redis would.
+type BoltLeaseQueue struct {
+	db          *bolt.DB
+	readyBucket []byte
+	leaseBucket []byte
+}
+
+// boltReadyEntry is the JSON shape stored in the ready bucket, keyed by
+// job key.
+type boltReadyEntry struct {
+	Value   string    `json:"value"`
+	ReadyAt time.Time `json:"ready_at"`
+}
+
+// boltLeaseEntry is the JSON shape stored in the lease bucket, keyed by
+// job key. A retried (Nacked but not dead-lettered) job's entry is kept
+// here even after it's back in the ready bucket, purely so the next
+// Lease can recover its attempts count.
+type boltLeaseEntry struct {
+	Value    string    `json:"value"`
+	Deadline time.Time `json:"deadline"`
+	Attempts int       `json:"attempts"`
+}
+
+// NewBoltLease opens (creating if necessary) the ready/leased buckets
+// in the BoltDB file at path.
+func NewBoltLease(path string) (*BoltLeaseQueue, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	q := &BoltLeaseQueue{db: db, readyBucket: []byte("ready"), leaseBucket: []byte("leased")}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(q.readyBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(q.leaseBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *BoltLeaseQueue) Add(key, value string) error {
+	return q.AddDelayed(key, value, time.Time{})
+}
+
+func (q *BoltLeaseQueue) AddDelayed(key, value string, readyAt time.Time) error {
+	b, err := json.Marshal(boltReadyEntry{Value: value, ReadyAt: readyAt})
+	if err != nil {
+		return err
+	}
+	return q.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(q.readyBucket).Put([]byte(key), b)
+	})
+}
+
+func (q *BoltLeaseQueue) Lease(owner string, ttl time.Duration) (key, value string, attempts int, err error) {
+	now := time.Now()
+	err = q.db.Update(func(tx *bolt.Tx) error {
+		ready := tx.Bucket(q.readyBucket)
+		leases := tx.Bucket(q.leaseBucket)
+
+		c := ready.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var entry boltReadyEntry
+			if jsonErr := json.Unmarshal(v, &entry); jsonErr != nil {
+				continue
+			}
+			if !entry.ReadyAt.IsZero() && entry.ReadyAt.After(now) {
+				continue
+			}
+			key, value = string(k), entry.Value
+			break
+		}
+		if key == "" {
+			return ErrNotFound
+		}
+		if err := ready.Delete([]byte(key)); err != nil {
+			return err
+		}
+
+		if existing := leases.Get([]byte(key)); existing != nil {
+			var prior boltLeaseEntry
+			if jsonErr := json.Unmarshal(existing, &prior); jsonErr == nil {
+				attempts = prior.Attempts
+			}
+		}
+		b, marshalErr := json.Marshal(boltLeaseEntry{Value: value, Deadline: now.Add(ttl), Attempts: attempts})
+		if marshalErr != nil {
+			return marshalErr
+		}
+		return leases.Put([]byte(key), b)
+	})
+	if err != nil {
+		return "", "", 0, err
+	}
+	return key, value, attempts, nil
+}
+
+func (q *BoltLeaseQueue) Has(key string) (has bool, err error) {
+	err = q.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(q.readyBucket).Get([]byte(key)) != nil {
+			has = true
+			return nil
+		}
+		has = tx.Bucket(q.leaseBucket).Get([]byte(key)) != nil
+		return nil
+	})
+	return
+}
+
+func (q *BoltLeaseQueue) Ack(key string) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(q.leaseBucket).Delete([]byte(key))
+	})
+}
+
+func (q *BoltLeaseQueue) Release(key string) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		leases := tx.Bucket(q.leaseBucket)
+		existing := leases.Get([]byte(key))
+		if existing == nil {
+			return nil
+		}
+		var lease boltLeaseEntry
+		if err := json.Unmarshal(existing, &lease); err != nil {
+			return err
+		}
+		// Leave the lease entry (and its attempts) in place, exactly
+		// as Nack does for a retried-but-not-dead-lettered job, so the
+		// next Lease recovers the real attempts count instead of
+		// treating this release as a fresh job.
+		b, err := json.Marshal(boltReadyEntry{Value: lease.Value})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(q.readyBucket).Put([]byte(key), b)
+	})
+}
+
+func (q *BoltLeaseQueue) Nack(key string, maxAttempts int, dead Queue) (deadLettered bool, err error) {
+	var deadValue string
+	txErr := q.db.Update(func(tx *bolt.Tx) error {
+		leases := tx.Bucket(q.leaseBucket)
+		existing := leases.Get([]byte(key))
+		if existing == nil {
+			return nil
+		}
+		var lease boltLeaseEntry
+		if jsonErr := json.Unmarshal(existing, &lease); jsonErr != nil {
+			return jsonErr
+		}
+		lease.Attempts++
+
+		if lease.Attempts >= maxAttempts {
+			deadLettered = true
+			deadValue = lease.Value
+			return leases.Delete([]byte(key))
+		}
+
+		b, marshalErr := json.Marshal(lease)
+		if marshalErr != nil {
+			return marshalErr
+		}
+		if err := leases.Put([]byte(key), b); err != nil {
+			return err
+		}
+		readyB, marshalErr := json.Marshal(boltReadyEntry{Value: lease.Value})
+		if marshalErr != nil {
+			return marshalErr
+		}
+		return tx.Bucket(q.readyBucket).Put([]byte(key), readyB)
+	})
+	if txErr != nil {
+		return false, txErr
+	}
+	if deadLettered && dead != nil {
+		return true, dead.Add(key, deadValue)
+	}
+	return deadLettered, nil
+}
+
+func (q *BoltLeaseQueue) ReapExpired() (int, error) {
+	now := time.Now()
+	n := 0
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		leases := tx.Bucket(q.leaseBucket)
+		ready := tx.Bucket(q.readyBucket)
+
+		var expired []struct {
+			key   []byte
+			value string
+		}
+		c := leases.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var lease boltLeaseEntry
+			if jsonErr := json.Unmarshal(v, &lease); jsonErr != nil {
+				continue
+			}
+			// a retried/released job already back in ready keeps its
+			// entry only so the next Lease recovers its attempts
+			if ready.Get(k) != nil {
+				continue
+			}
+			if lease.Deadline.Before(now) {
+				expired = append(expired, struct {
+					key   []byte
+					value string
+				}{append([]byte(nil), k...), lease.Value})
+			}
+		}
+		for _, e := range expired {
+			if err := leases.Delete(e.key); err != nil {
+				return err
+			}
+			b, err := json.Marshal(boltReadyEntry{Value: e.value})
+			if err != nil {
+				return err
+			}
+			if err := ready.Put(e.key, b); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (q *BoltLeaseQueue) ReadySize() (int64, error) {
+	var n int64
+	err := q.db.View(func(tx *bolt.Tx) error {
+		n = int64(tx.Bucket(q.readyBucket).Stats().KeyN)
+		return nil
+	})
+	return n, err
+}
+
+func (q *BoltLeaseQueue) LeasedSize() (int64, error) {
+	var n int64
+	err := q.db.View(func(tx *bolt.Tx) error {
+		n = int64(tx.Bucket(q.leaseBucket).Stats().KeyN)
+		return nil
+	})
+	return n, err
+}
+
+func (q *BoltLeaseQueue) Scan() ([]string, error) {
+	var keys []string
+	err := q.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(q.readyBucket).ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	return keys, err
+}
+
+func (q *BoltLeaseQueue) Flush() error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(q.readyBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucket(q.readyBucket); err != nil {
+			return err
+		}
+		if err := tx.DeleteBucket(q.leaseBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(q.leaseBucket)
+		return err
+	})
+}
+
+func (q *BoltLeaseQueue) Close() error {
+	return q.db.Close()
+}
@@ -0,0 +1,192 @@
+package queue
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestBoltLease(t *testing.T) *BoltLeaseQueue {
+	t.Helper()
+	q, err := NewBoltLease(filepath.Join(t.TempDir(), "jobs.db"))
+	if err != nil {
+		t.Fatalf("NewBoltLease: %v", err)
+	}
+	t.Cleanup(func() { q.Close() })
+	return q
+}
+
+func TestBoltLeaseQueueLeaseAck(t *testing.T) {
+	q := newTestBoltLease(t)
+
+	if err := q.Add("https://example.com/a", "pageA"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if n, _ := q.ReadySize(); n != 1 {
+		t.Fatalf("ReadySize = %d, want 1", n)
+	}
+
+	key, value, attempts, err := q.Lease("worker-1", time.Minute)
+	if err != nil {
+		t.Fatalf("Lease: %v", err)
+	}
+	if key != "https://example.com/a" || value != "pageA" || attempts != 0 {
+		t.Errorf("Lease = (%q, %q, %d), want (\"https://example.com/a\", \"pageA\", 0)", key, value, attempts)
+	}
+	if n, _ := q.ReadySize(); n != 0 {
+		t.Errorf("ReadySize after Lease = %d, want 0", n)
+	}
+	if n, _ := q.LeasedSize(); n != 1 {
+		t.Errorf("LeasedSize after Lease = %d, want 1", n)
+	}
+
+	if err := q.Ack(key); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	if n, _ := q.LeasedSize(); n != 0 {
+		t.Errorf("LeasedSize after Ack = %d, want 0", n)
+	}
+}
+
+func TestBoltLeaseQueueLeaseHonorsReadyAt(t *testing.T) {
+	q := newTestBoltLease(t)
+
+	future := time.Now().Add(time.Hour)
+	if err := q.AddDelayed("https://example.com/later", "later", future); err != nil {
+		t.Fatalf("AddDelayed: %v", err)
+	}
+	if _, _, _, err := q.Lease("worker-1", time.Minute); err != ErrNotFound {
+		t.Errorf("Lease before readyAt = %v, want ErrNotFound", err)
+	}
+
+	if err := q.AddDelayed("https://example.com/now", "now", time.Time{}); err != nil {
+		t.Fatalf("AddDelayed: %v", err)
+	}
+	key, _, _, err := q.Lease("worker-1", time.Minute)
+	if err != nil {
+		t.Fatalf("Lease: %v", err)
+	}
+	if key != "https://example.com/now" {
+		t.Errorf("Lease returned %q, want the already-ready key", key)
+	}
+}
+
+func TestBoltLeaseQueueNackRetriesThenDeadLetters(t *testing.T) {
+	q := newTestBoltLease(t)
+	dead := newTestBoltQueue(t)
+
+	if err := q.Add("https://example.com/flaky", "flaky"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	const maxAttempts = 2
+	for i := 0; i < maxAttempts-1; i++ {
+		key, _, _, err := q.Lease("worker-1", time.Minute)
+		if err != nil {
+			t.Fatalf("Lease attempt %d: %v", i, err)
+		}
+		deadLettered, err := q.Nack(key, maxAttempts, dead)
+		if err != nil {
+			t.Fatalf("Nack attempt %d: %v", i, err)
+		}
+		if deadLettered {
+			t.Fatalf("Nack attempt %d dead-lettered too early", i)
+		}
+	}
+
+	key, _, attempts, err := q.Lease("worker-1", time.Minute)
+	if err != nil {
+		t.Fatalf("final Lease: %v", err)
+	}
+	if attempts != maxAttempts-1 {
+		t.Errorf("attempts before final Nack = %d, want %d", attempts, maxAttempts-1)
+	}
+	deadLettered, err := q.Nack(key, maxAttempts, dead)
+	if err != nil {
+		t.Fatalf("final Nack: %v", err)
+	}
+	if !deadLettered {
+		t.Error("final Nack should have dead-lettered the job")
+	}
+	if val, err := dead.Get(key); err != nil || val != "flaky" {
+		t.Errorf("dead queue Get(%q) = (%q, %v), want (\"flaky\", nil)", key, val, err)
+	}
+	if n, _ := q.ReadySize(); n != 0 {
+		t.Errorf("ReadySize after dead-lettering = %d, want 0", n)
+	}
+}
+
+func TestBoltLeaseQueueReleasePreservesAttempts(t *testing.T) {
+	q := newTestBoltLease(t)
+	dead := newTestBoltQueue(t)
+
+	if err := q.Add("https://example.com/slow-host", "slow-host"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	key, _, _, err := q.Lease("worker-1", time.Minute)
+	if err != nil {
+		t.Fatalf("Lease: %v", err)
+	}
+	if _, err := q.Nack(key, 5, dead); err != nil {
+		t.Fatalf("Nack: %v", err)
+	}
+
+	key, _, attempts, err := q.Lease("worker-1", time.Minute)
+	if err != nil {
+		t.Fatalf("Lease after Nack: %v", err)
+	}
+	if attempts != 1 {
+		t.Fatalf("attempts after Nack = %d, want 1", attempts)
+	}
+
+	// A rate-limit deferral (Release) should not reset the attempts
+	// already accrued from the real failure above.
+	if err := q.Release(key); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	_, _, attempts, err = q.Lease("worker-1", time.Minute)
+	if err != nil {
+		t.Fatalf("Lease after Release: %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("attempts after Release = %d, want 1 (Release must not reset attempts)", attempts)
+	}
+}
+
+func TestBoltLeaseQueueReapExpired(t *testing.T) {
+	q := newTestBoltLease(t)
+
+	if err := q.Add("https://example.com/stuck", "stuck"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if _, _, _, err := q.Lease("worker-1", time.Millisecond); err != nil {
+		t.Fatalf("Lease: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	n, err := q.ReapExpired()
+	if err != nil {
+		t.Fatalf("ReapExpired: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("ReapExpired reclaimed %d leases, want 1", n)
+	}
+	if n, _ := q.ReadySize(); n != 1 {
+		t.Errorf("ReadySize after reap = %d, want 1", n)
+	}
+	if n, _ := q.LeasedSize(); n != 0 {
+		t.Errorf("LeasedSize after reap = %d, want 0", n)
+	}
+}
+
+func newTestBoltQueue(t *testing.T) *BoltQueue {
+	t.Helper()
+	q, err := NewBolt(filepath.Join(t.TempDir(), "dead.db"), "trash")
+	if err != nil {
+		t.Fatalf("NewBolt: %v", err)
+	}
+	t.Cleanup(func() { q.Close() })
+	return q
+}
@@ -0,0 +1,44 @@
+package queue
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ConnStr is a parsed "addrs=host1:6379,host2:6379 master=mymaster db=0"
+// style connection string, the same shape Gitea and Harbor use for their
+// Redis Sentinel/Cluster configuration.
+type ConnStr struct {
+	Addrs    []string
+	Master   string
+	DB       int
+	Password string
+}
+
+// ParseConnStr parses s into a ConnStr. Unknown fields are ignored so the
+// format can grow without breaking older configs.
+func ParseConnStr(s string) (ConnStr, error) {
+	cs := ConnStr{DB: 0}
+	for _, field := range strings.Fields(s) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, val := kv[0], kv[1]
+		switch key {
+		case "addrs":
+			cs.Addrs = strings.Split(val, ",")
+		case "master":
+			cs.Master = val
+		case "password":
+			cs.Password = val
+		case "db":
+			db, err := strconv.Atoi(val)
+			if err != nil {
+				return cs, err
+			}
+			cs.DB = db
+		}
+	}
+	return cs, nil
+}
@@ -0,0 +1,52 @@
+package queue
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseConnStr(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want ConnStr
+	}{
+		{
+			name: "full sentinel string",
+			in:   "addrs=host1:6379,host2:6379 master=mymaster db=2 password=secret",
+			want: ConnStr{Addrs: []string{"host1:6379", "host2:6379"}, Master: "mymaster", DB: 2, Password: "secret"},
+		},
+		{
+			name: "cluster string has no master",
+			in:   "addrs=host1:6379,host2:6379,host3:6379",
+			want: ConnStr{Addrs: []string{"host1:6379", "host2:6379", "host3:6379"}, DB: 0},
+		},
+		{
+			name: "unknown fields are ignored",
+			in:   "addrs=host1:6379 future=field",
+			want: ConnStr{Addrs: []string{"host1:6379"}, DB: 0},
+		},
+		{
+			name: "empty string",
+			in:   "",
+			want: ConnStr{DB: 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseConnStr(tt.in)
+			if err != nil {
+				t.Fatalf("ParseConnStr(%q) returned error: %v", tt.in, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseConnStr(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseConnStrBadDB(t *testing.T) {
+	if _, err := ParseConnStr("addrs=host1:6379 db=notanumber"); err == nil {
+		t.Error("ParseConnStr with a non-numeric db= should return an error")
+	}
+}
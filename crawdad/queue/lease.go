@@ -0,0 +1,48 @@
+package queue
+
+import "time"
+
+// LeaseQueue is a crash-safe job queue: a worker claims a job with Lease
+// for a bounded time, then must Ack (job succeeded) or Nack (job failed,
+// retried up to maxAttempts before dead-lettering) before the lease
+// expires. Anything left unacknowledged past its deadline is returned to
+// the ready set by ReapExpired, so a worker that crashes mid-fetch can't
+// strand a job forever the way the old todo.RandomKey/doing.Set dance
+// could.
+type LeaseQueue interface {
+	// Add makes key immediately eligible for Lease.
+	Add(key, value string) error
+	// AddDelayed makes key eligible for Lease only once readyAt has
+	// passed, honoring a host's Crawl-delay.
+	AddDelayed(key, value string, readyAt time.Time) error
+	// Lease claims one ready job for owner until ttl from now, returning
+	// ErrNotFound if nothing is ready.
+	Lease(owner string, ttl time.Duration) (key, value string, attempts int, err error)
+	// Has reports whether key is currently ready or leased.
+	Has(key string) (bool, error)
+	// Ack removes a leased key; the job succeeded.
+	Ack(key string) error
+	// Release returns a leased key to the ready set without counting it
+	// as a failed attempt, e.g. when a rate limit deferred the fetch.
+	Release(key string) error
+	// Nack returns a leased key to the ready set for retry. Once the
+	// job's attempts reach maxAttempts it is moved to dead instead and
+	// deadLettered is true.
+	Nack(key string, maxAttempts int, dead Queue) (deadLettered bool, err error)
+	// ReapExpired returns every lease past its deadline to the ready
+	// set and reports how many were reclaimed.
+	ReapExpired() (int, error)
+	// ReadySize returns the number of jobs in the ready set, including
+	// delayed ones whose readyAt has not passed yet.
+	ReadySize() (int64, error)
+	// LeasedSize returns the number of entries in the lease set: jobs
+	// leased out now, plus retried or released jobs whose attempts count
+	// is kept there until their next Lease.
+	LeasedSize() (int64, error)
+	// Scan returns every ready key.
+	Scan() ([]string, error)
+	// Flush removes every ready and leased job.
+	Flush() error
+	// Close releases any connections or file handles held by the queue.
+	Close() error
+}
@@ -0,0 +1,29 @@
+// Package queue abstracts the storage backend crawdad uses for its
+// todo/doing/done/trash lists, so a crawl can run against plain Redis, a
+// Redis Sentinel/Cluster deployment, or an embedded BoltDB with no
+// external dependency at all.
+package queue
+
+import "errors"
+
+// ErrNotFound is returned by Get when the requested key isn't in the queue.
+var ErrNotFound = errors.New("queue: key not found")
+
+// Queue is a key/value set with the handful of operations the crawler
+// needs to move URLs between its todo/doing/done/trash lists.
+type Queue interface {
+	// Add stores value under key, creating or overwriting it.
+	Add(key, value string) error
+	// Get returns the value stored under key, or ErrNotFound.
+	Get(key string) (string, error)
+	// Del removes key, if present.
+	Del(key string) error
+	// Size returns the number of keys currently stored.
+	Size() (int64, error)
+	// Scan returns every key currently stored.
+	Scan() ([]string, error)
+	// Flush removes every key.
+	Flush() error
+	// Close releases any connections or file handles held by the queue.
+	Close() error
+}
@@ -0,0 +1,65 @@
+package queue
+
+import (
+	"github.com/go-redis/redis"
+)
+
+// RedisQueue is a Queue backed by a single-node Redis instance, using one
+// DB index per queue the same way crawdad always has.
+type RedisQueue struct {
+	client *redis.Client
+}
+
+// NewRedis connects to addr (host:port) and returns a Queue backed by the
+// given Redis DB index.
+func NewRedis(addr, password string, db int) (*RedisQueue, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: password,
+		DB:       db,
+	})
+	if _, err := client.Ping().Result(); err != nil {
+		return nil, err
+	}
+	return &RedisQueue{client: client}, nil
+}
+
+func (q *RedisQueue) Add(key, value string) error {
+	return q.client.Set(key, value, 0).Err()
+}
+
+func (q *RedisQueue) Get(key string) (string, error) {
+	val, err := q.client.Get(key).Result()
+	if err == redis.Nil {
+		return "", ErrNotFound
+	}
+	return val, err
+}
+
+func (q *RedisQueue) Del(key string) error {
+	return q.client.Del(key).Err()
+}
+
+func (q *RedisQueue) Size() (int64, error) {
+	return q.client.DbSize().Result()
+}
+
+func (q *RedisQueue) Scan() ([]string, error) {
+	var keys []string
+	iter := q.client.Scan(0, "", 0).Iterator()
+	for iter.Next() {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+func (q *RedisQueue) Flush() error {
+	// FlushDB, not FlushAll: this queue owns only its own DB index, and
+	// the done/trash/settings/robots/dedup DBs all live on the same
+	// Redis server.
+	return q.client.FlushDB().Err()
+}
+
+func (q *RedisQueue) Close() error {
+	return q.client.Close()
+}
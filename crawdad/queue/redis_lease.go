@@ -0,0 +1,281 @@
+package queue
+
+import (
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// RedisLeaseQueue implements LeaseQueue on top of any redis.Cmdable
+// (a standalone *redis.Client, the *redis.Client NewFailoverClient hands
+// back for a Sentinel-monitored master, or a *redis.ClusterClient, whose
+// keys must then be hash-tagged by the caller so the scripts below stay
+// within a single slot). Ready jobs live in a sorted set scored by
+// ready-at unix time; in-flight leases live in a hash keyed by the same
+// job key, each holding {owner, deadline, attempts, value} as JSON so
+// the leasing logic is a single atomic script regardless of which
+// instance executes it. The value field there stays empty: job values
+// live in a separate hash written by AddDelayed.
+type RedisLeaseQueue struct {
+	client   redis.Cmdable
+	readyKey string
+	leaseKey string
+
+	leaseScript   *redis.Script
+	nackScript    *redis.Script
+	releaseScript *redis.Script
+	reapScript    *redis.Script
+}
+
+// NewRedisLease connects to addr (host:port) and returns a LeaseQueue
+// backed by Redis DB index db, using name to namespace its keys.
+func NewRedisLease(addr, password string, db int, name string) (*RedisLeaseQueue, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: password,
+		DB:       db,
+	})
+	if _, err := client.Ping().Result(); err != nil {
+		return nil, err
+	}
+	return newRedisLeaseQueue(client, name), nil
+}
+
+// NewRedisLeaseFromClient wraps an already-connected redis.Cmdable (e.g.
+// a *redis.Client built with redis.NewFailoverClient for Sentinel, or a
+// *redis.ClusterClient) in a LeaseQueue. For a ClusterClient, name must
+// be hash-tagged (e.g. "{crawdad:jobs}") so every key the leasing
+// scripts touch lands on the same cluster slot.
+func NewRedisLeaseFromClient(client redis.Cmdable, name string) *RedisLeaseQueue {
+	return newRedisLeaseQueue(client, name)
+}
+
+func newRedisLeaseQueue(client redis.Cmdable, name string) *RedisLeaseQueue {
+	return &RedisLeaseQueue{
+		client:   client,
+		readyKey: name + ":ready",
+		leaseKey: name + ":leases",
+		leaseScript: redis.NewScript(`
+			local ready = KEYS[1]
+			local leases = KEYS[2]
+			local now = tonumber(ARGV[1])
+			local ttl = tonumber(ARGV[2])
+			local owner = ARGV[3]
+
+			local members = redis.call('ZRANGEBYSCORE', ready, '-inf', now, 'LIMIT', 0, 1)
+			if #members == 0 then
+				return false
+			end
+			local key = members[1]
+			redis.call('ZREM', ready, key)
+
+			local attempts = 0
+			local value = ''
+			local existing = redis.call('HGET', leases, key)
+			if existing then
+				local rec = cjson.decode(existing)
+				attempts = rec.attempts
+				value = rec.value
+			end
+
+			local rec = cjson.encode({owner=owner, deadline=now+ttl, attempts=attempts, value=value})
+			redis.call('HSET', leases, key, rec)
+			return {key, value, attempts}
+		`),
+		nackScript: redis.NewScript(`
+			local leases = KEYS[1]
+			local ready = KEYS[2]
+			local dead = KEYS[3]
+			local key = ARGV[1]
+			local maxAttempts = tonumber(ARGV[2])
+			local now = tonumber(ARGV[3])
+
+			local existing = redis.call('HGET', leases, key)
+			if not existing then
+				return false
+			end
+			local rec = cjson.decode(existing)
+			rec.attempts = rec.attempts + 1
+			redis.call('HDEL', leases, key)
+
+			if rec.attempts >= maxAttempts then
+				if dead ~= '' then
+					redis.call('SET', dead, rec.value)
+				end
+				return true
+			end
+			redis.call('ZADD', ready, now, key)
+			redis.call('HSET', leases, key, cjson.encode(rec))
+			return false
+		`),
+		releaseScript: redis.NewScript(`
+			local leases = KEYS[1]
+			local ready = KEYS[2]
+			local key = ARGV[1]
+			local now = tonumber(ARGV[2])
+
+			local existing = redis.call('HGET', leases, key)
+			if not existing then
+				return false
+			end
+			local rec = cjson.decode(existing)
+			redis.call('ZADD', ready, now, key)
+			redis.call('HSET', leases, key, cjson.encode(rec))
+			return true
+		`),
+		reapScript: redis.NewScript(`
+			local leases = KEYS[1]
+			local ready = KEYS[2]
+			local now = tonumber(ARGV[1])
+			local all = redis.call('HGETALL', leases)
+			local n = 0
+			for i = 1, #all, 2 do
+				local key = all[i]
+				local rec = cjson.decode(all[i+1])
+				-- skip retried/released jobs already back in ready; their
+				-- entry only carries attempts for the next lease
+				if rec.deadline < now and not redis.call('ZSCORE', ready, key) then
+					redis.call('HDEL', leases, key)
+					redis.call('ZADD', ready, now, key)
+					n = n + 1
+				end
+			end
+			return n
+		`),
+	}
+}
+
+func (q *RedisLeaseQueue) Add(key, value string) error {
+	return q.AddDelayed(key, value, time.Time{})
+}
+
+func (q *RedisLeaseQueue) AddDelayed(key, value string, readyAt time.Time) error {
+	score := float64(0)
+	if !readyAt.IsZero() {
+		// round up to whole seconds, since Lease compares against a
+		// truncated unix time and must not lease the key early
+		sec := readyAt.Unix()
+		if readyAt.Nanosecond() > 0 {
+			sec++
+		}
+		score = float64(sec)
+	}
+	pipe := q.client.TxPipeline()
+	pipe.HSet(q.leaseKey+":values", key, value)
+	pipe.ZAdd(q.readyKey, redis.Z{Score: score, Member: key})
+	_, err := pipe.Exec()
+	return err
+}
+
+func (q *RedisLeaseQueue) Lease(owner string, ttl time.Duration) (key, value string, attempts int, err error) {
+	now := time.Now().Unix()
+	res, err := q.leaseScript.Run(q.client, []string{q.readyKey, q.leaseKey}, now, int64(ttl.Seconds()), owner).Result()
+	if err == redis.Nil {
+		// the script returns false when nothing is ready
+		return "", "", 0, ErrNotFound
+	}
+	if err != nil {
+		return "", "", 0, err
+	}
+	parts, ok := res.([]interface{})
+	if !ok || len(parts) != 3 {
+		return "", "", 0, ErrNotFound
+	}
+	key, _ = parts[0].(string)
+	// the lease record's value field is left empty by the script, so
+	// the value comes from the separate values hash populated by
+	// AddDelayed.
+	value, _ = parts[1].(string)
+	if value == "" {
+		value, _ = q.client.HGet(q.leaseKey+":values", key).Result()
+	}
+	attempts64, _ := parts[2].(int64)
+	return key, value, int(attempts64), nil
+}
+
+func (q *RedisLeaseQueue) Has(key string) (bool, error) {
+	_, err := q.client.ZScore(q.readyKey, key).Result()
+	if err == nil {
+		return true, nil
+	}
+	if err != redis.Nil {
+		return false, err
+	}
+	return q.client.HExists(q.leaseKey, key).Result()
+}
+
+func (q *RedisLeaseQueue) Ack(key string) error {
+	pipe := q.client.TxPipeline()
+	pipe.HDel(q.leaseKey, key)
+	pipe.HDel(q.leaseKey+":values", key)
+	_, err := pipe.Exec()
+	return err
+}
+
+func (q *RedisLeaseQueue) Release(key string) error {
+	_, err := q.releaseScript.Run(q.client, []string{q.leaseKey, q.readyKey}, key, 0).Result()
+	return err
+}
+
+func (q *RedisLeaseQueue) Nack(key string, maxAttempts int, dead Queue) (bool, error) {
+	// Stash the dead-letter target out of band: the Lua script only
+	// knows how to SET a plain key, so when dead-lettering is requested
+	// we hand it a scratch key and move the value into dst ourselves.
+	scratch := ""
+	if dead != nil {
+		scratch = q.leaseKey + ":dead:" + key
+	}
+	res, err := q.nackScript.Run(q.client, []string{q.leaseKey, q.readyKey, scratch}, key, maxAttempts, time.Now().Unix()).Result()
+	if err == redis.Nil {
+		// the script returns false for a plain retry (or no lease)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	deadLettered, _ := res.(int64)
+	if deadLettered == 1 && dead != nil {
+		value, _ := q.client.Get(scratch).Result()
+		if value == "" {
+			value, _ = q.client.HGet(q.leaseKey+":values", key).Result()
+		}
+		q.client.Del(scratch)
+		q.client.HDel(q.leaseKey+":values", key)
+		return true, dead.Add(key, value)
+	}
+	return false, nil
+}
+
+func (q *RedisLeaseQueue) ReapExpired() (int, error) {
+	res, err := q.reapScript.Run(q.client, []string{q.leaseKey, q.readyKey}, time.Now().Unix()).Result()
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.(int64)
+	return int(n), nil
+}
+
+func (q *RedisLeaseQueue) ReadySize() (int64, error) {
+	return q.client.ZCard(q.readyKey).Result()
+}
+
+func (q *RedisLeaseQueue) LeasedSize() (int64, error) {
+	return q.client.HLen(q.leaseKey).Result()
+}
+
+func (q *RedisLeaseQueue) Scan() ([]string, error) {
+	return q.client.ZRange(q.readyKey, 0, -1).Result()
+}
+
+func (q *RedisLeaseQueue) Flush() error {
+	pipe := q.client.TxPipeline()
+	pipe.Del(q.readyKey)
+	pipe.Del(q.leaseKey)
+	pipe.Del(q.leaseKey + ":values")
+	_, err := pipe.Exec()
+	return err
+}
+
+func (q *RedisLeaseQueue) Close() error {
+	return q.client.Close()
+}
@@ -0,0 +1,110 @@
+package queue
+
+import (
+	"strings"
+
+	"github.com/go-redis/redis"
+)
+
+// SentinelQueue is a Queue backed by a highly-available Redis deployment:
+// a Sentinel-monitored master/replica set when ConnStr.Master is set, or a
+// Redis Cluster otherwise. Multiple crawdad instances can point at the
+// same SentinelQueue and share one done/trash state.
+//
+// Keys are namespaced by a "name:" prefix rather than by Redis DB index:
+// a Cluster has no SELECT, so cs.DB is meaningless there, and the prefix
+// works the same way regardless of which mode NewSentinel picked.
+type SentinelQueue struct {
+	failover *redis.Client
+	cluster  *redis.ClusterClient
+	prefix   string
+}
+
+// NewSentinel builds a SentinelQueue from a parsed ConnStr, namespacing
+// its keys under name so that, e.g., "done" and "trash" don't collide
+// in the flat keyspace a Redis Cluster gives you.
+func NewSentinel(cs ConnStr, name string) (*SentinelQueue, error) {
+	q := &SentinelQueue{prefix: name + ":"}
+	if cs.Master != "" {
+		q.failover = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    cs.Master,
+			SentinelAddrs: cs.Addrs,
+			Password:      cs.Password,
+			DB:            cs.DB,
+		})
+		if _, err := q.failover.Ping().Result(); err != nil {
+			return nil, err
+		}
+		return q, nil
+	}
+	q.cluster = redis.NewClusterClient(&redis.ClusterOptions{
+		Addrs:    cs.Addrs,
+		Password: cs.Password,
+	})
+	if _, err := q.cluster.Ping().Result(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *SentinelQueue) cmdable() redis.Cmdable {
+	if q.failover != nil {
+		return q.failover
+	}
+	return q.cluster
+}
+
+func (q *SentinelQueue) Add(key, value string) error {
+	return q.cmdable().Set(q.prefix+key, value, 0).Err()
+}
+
+func (q *SentinelQueue) Get(key string) (string, error) {
+	val, err := q.cmdable().Get(q.prefix + key).Result()
+	if err == redis.Nil {
+		return "", ErrNotFound
+	}
+	return val, err
+}
+
+func (q *SentinelQueue) Del(key string) error {
+	return q.cmdable().Del(q.prefix + key).Err()
+}
+
+func (q *SentinelQueue) Size() (int64, error) {
+	// Neither DbSize (failover mode shares the DB with other queues'
+	// prefixes) nor Cluster (no single keyspace size at all) can answer
+	// this directly; approximate with a prefixed key scan count.
+	keys, err := q.Scan()
+	return int64(len(keys)), err
+}
+
+func (q *SentinelQueue) Scan() ([]string, error) {
+	var keys []string
+	iter := q.cmdable().Scan(0, q.prefix+"*", 0).Iterator()
+	for iter.Next() {
+		keys = append(keys, strings.TrimPrefix(iter.Val(), q.prefix))
+	}
+	return keys, iter.Err()
+}
+
+func (q *SentinelQueue) Flush() error {
+	keys, err := q.Scan()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	prefixed := make([]string, len(keys))
+	for i, k := range keys {
+		prefixed[i] = q.prefix + k
+	}
+	return q.cmdable().Del(prefixed...).Err()
+}
+
+func (q *SentinelQueue) Close() error {
+	if q.failover != nil {
+		return q.failover.Close()
+	}
+	return q.cluster.Close()
+}
@@ -0,0 +1,227 @@
+package crawdad
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// robotsTTL is how long a fetched robots.txt is cached for before being
+// re-fetched from the host.
+const robotsTTL = 24 * time.Hour
+
+// crawlDelayScript atomically reserves the next Crawl-delay slot for a
+// host: it reads the previously reserved deadline, advances it by delay
+// (or starts from now if nothing was reserved or the reservation has
+// already passed), and writes the new deadline back, all in one round
+// trip so two workers racing on the same host can never read-compute-
+// write the same readyAt. Everything is millisecond, not nanosecond,
+// precision: Redis Lua numbers are float64s, which can't represent a
+// UnixNano timestamp exactly, but comfortably cover UnixMilli.
+var crawlDelayScript = redis.NewScript(`
+	local key = KEYS[1]
+	local nowMillis = tonumber(ARGV[1])
+	local delayMillis = tonumber(ARGV[2])
+	local ttlMillis = tonumber(ARGV[3])
+
+	local readyAtMillis = nowMillis
+	local reserved = tonumber(redis.call('GET', key))
+	if reserved and reserved > nowMillis then
+		readyAtMillis = reserved
+	end
+	redis.call('SET', key, readyAtMillis + delayMillis, 'PX', ttlMillis)
+	return readyAtMillis
+`)
+
+// robotsRules holds the directives parsed out of a single robots.txt that
+// apply to the "*" user agent.
+type robotsRules struct {
+	Disallow   []string      `json:"disallow"`
+	Allow      []string      `json:"allow"`
+	CrawlDelay time.Duration `json:"crawl_delay"`
+}
+
+// hostOf returns the scheme+host portion of rawurl, used as the cache and
+// rate-limit key for robots.txt and politeness state.
+func hostOf(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	return u.Scheme + "://" + u.Host, nil
+}
+
+// robotsAllowed reports whether rawurl may be fetched according to the
+// cached (or freshly fetched) robots.txt for host.
+func (c *Crawler) robotsAllowed(host, rawurl string) (bool, error) {
+	rules, err := c.getRobotsRules(host)
+	if err != nil {
+		return false, err
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return false, err
+	}
+	return rules.allowed(u.Path), nil
+}
+
+// getRobotsRules returns the robots.txt rules for host, fetching and
+// caching them in Redis if they aren't already cached.
+func (c *Crawler) getRobotsRules(host string) (rules *robotsRules, err error) {
+	cacheKey := "robots:" + host
+	val, err := c.robots.Get(cacheKey).Result()
+	if err == nil {
+		rules = new(robotsRules)
+		if jsonErr := json.Unmarshal([]byte(val), rules); jsonErr == nil {
+			return rules, nil
+		}
+	} else if err != redis.Nil {
+		return nil, err
+	}
+
+	rules = c.fetchRobotsRules(host)
+	b, marshalErr := json.Marshal(rules)
+	if marshalErr == nil {
+		c.robots.Set(cacheKey, string(b), robotsTTL).Result()
+	}
+	return rules, nil
+}
+
+// fetchRobotsRules downloads and parses host+"/robots.txt". Any failure to
+// fetch it is treated as "no restrictions", per the usual robots.txt
+// convention.
+func (c *Crawler) fetchRobotsRules(host string) *robotsRules {
+	rules := &robotsRules{CrawlDelay: c.Settings.DefaultCrawlDelay}
+	resp, err := c.client.Get(host + "/robots.txt")
+	if err != nil {
+		c.log.Debugf("No robots.txt for %s: %s", host, err.Error())
+		return rules
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return rules
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return rules
+	}
+	parseRobotsTxt(string(body), rules)
+	return rules
+}
+
+// parseRobotsTxt fills in rules from the body of a robots.txt, honoring
+// only the records that apply to the "*" user agent.
+func parseRobotsTxt(body string, rules *robotsRules) {
+	applies := false
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		field := strings.ToLower(strings.TrimSpace(parts[0]))
+		value := strings.TrimSpace(parts[1])
+		switch field {
+		case "user-agent":
+			applies = value == "*"
+		case "disallow":
+			if applies && value != "" {
+				rules.Disallow = append(rules.Disallow, value)
+			}
+		case "allow":
+			if applies && value != "" {
+				rules.Allow = append(rules.Allow, value)
+			}
+		case "crawl-delay":
+			if applies {
+				if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+					rules.CrawlDelay = time.Duration(seconds * float64(time.Second))
+				}
+			}
+		}
+	}
+}
+
+// allowed reports whether path is fetchable under r, using the standard
+// "longest matching rule wins, Allow breaks ties" semantics.
+func (r *robotsRules) allowed(path string) bool {
+	longestAllow := -1
+	longestDisallow := -1
+	for _, prefix := range r.Allow {
+		if strings.HasPrefix(path, prefix) && len(prefix) > longestAllow {
+			longestAllow = len(prefix)
+		}
+	}
+	for _, prefix := range r.Disallow {
+		if strings.HasPrefix(path, prefix) && len(prefix) > longestDisallow {
+			longestDisallow = len(prefix)
+		}
+	}
+	if longestDisallow == -1 {
+		return true
+	}
+	return longestAllow >= longestDisallow
+}
+
+// crawlDelayReadyAt reserves the next fetch slot for host and reports
+// when a newly queued link for it may be leased, honoring the host's
+// robots.txt Crawl-delay (or Settings.DefaultCrawlDelay if the host
+// doesn't advertise one). The reservation is kept in Redis so every
+// distributed crawdad instance spaces its fetches of host by at least
+// CrawlDelay. A host with no delay gets back the zero Time, meaning
+// "ready immediately".
+func (c *Crawler) crawlDelayReadyAt(host string) (time.Time, error) {
+	rules, err := c.getRobotsRules(host)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if rules.CrawlDelay <= 0 {
+		return time.Time{}, nil
+	}
+
+	key := "crawldelay:next:" + host
+	nowMillis := time.Now().UnixNano() / int64(time.Millisecond)
+	delayMillis := rules.CrawlDelay.Milliseconds()
+	ttlMillis := (rules.CrawlDelay + time.Minute).Milliseconds()
+	res, err := crawlDelayScript.Run(c.robots, []string{key}, nowMillis, delayMillis, ttlMillis).Result()
+	if err != nil {
+		return time.Time{}, err
+	}
+	readyAtMillis, ok := res.(int64)
+	if !ok {
+		return time.Time{}, errors.New("crawlDelayScript: unexpected result type")
+	}
+	return time.Unix(0, readyAtMillis*int64(time.Millisecond)), nil
+}
+
+// allowHost counts this request against host's shared request counter for
+// the current one-second window, kept in Redis (INCR+EXPIRE) so that every
+// distributed crawdad instance hitting the same host shares one limit. It
+// returns false once the window's count exceeds Settings.PerHostQPS,
+// rounded down but never below 1 (so a fractional QPS under 1 still
+// allows 1 request per second).
+func (c *Crawler) allowHost(host string) (bool, error) {
+	window := time.Now().UnixNano() / int64(time.Second)
+	key := "ratelimit:" + host + ":" + strconv.FormatInt(window, 10)
+
+	count, err := c.robots.Incr(key).Result()
+	if err != nil {
+		return false, err
+	}
+	if count == 1 {
+		c.robots.Expire(key, 2*time.Second).Result()
+	}
+
+	limit := int64(math.Max(1, math.Floor(c.Settings.PerHostQPS)))
+	return count <= limit, nil
+}
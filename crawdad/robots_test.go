@@ -0,0 +1,93 @@
+package crawdad
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRobotsRulesAllowed(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules robotsRules
+		path  string
+		want  bool
+	}{
+		{
+			name:  "no rules means everything allowed",
+			rules: robotsRules{},
+			path:  "/private/",
+			want:  true,
+		},
+		{
+			name:  "disallowed prefix blocks",
+			rules: robotsRules{Disallow: []string{"/private/"}},
+			path:  "/private/secrets",
+			want:  false,
+		},
+		{
+			name:  "unrelated disallow doesn't block",
+			rules: robotsRules{Disallow: []string{"/private/"}},
+			path:  "/public/page",
+			want:  true,
+		},
+		{
+			name:  "longer allow overrides shorter disallow",
+			rules: robotsRules{Disallow: []string{"/"}, Allow: []string{"/public/"}},
+			path:  "/public/page",
+			want:  true,
+		},
+		{
+			name:  "longer disallow overrides shorter allow",
+			rules: robotsRules{Disallow: []string{"/public/secret/"}, Allow: []string{"/public/"}},
+			path:  "/public/secret/page",
+			want:  false,
+		},
+		{
+			name:  "equal-length allow and disallow: allow wins the tie",
+			rules: robotsRules{Disallow: []string{"/x/"}, Allow: []string{"/x/"}},
+			path:  "/x/page",
+			want:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rules.allowed(tt.path); got != tt.want {
+				t.Errorf("allowed(%q) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRobotsTxt(t *testing.T) {
+	body := `
+# comment lines are ignored
+User-agent: Googlebot
+Disallow: /googlebot-only/
+
+User-agent: *
+Disallow: /private/
+Allow: /private/public-page
+Crawl-delay: 2.5
+`
+	rules := &robotsRules{}
+	parseRobotsTxt(body, rules)
+
+	if got := rules.Disallow; len(got) != 1 || got[0] != "/private/" {
+		t.Errorf("Disallow = %v, want only rules for the \"*\" user-agent", got)
+	}
+	if got := rules.Allow; len(got) != 1 || got[0] != "/private/public-page" {
+		t.Errorf("Allow = %v, want only rules for the \"*\" user-agent", got)
+	}
+	if rules.CrawlDelay != 2500*time.Millisecond {
+		t.Errorf("CrawlDelay = %v, want 2.5s", rules.CrawlDelay)
+	}
+}
+
+func TestParseRobotsTxtKeepsDefaultCrawlDelayWhenUnspecified(t *testing.T) {
+	rules := &robotsRules{CrawlDelay: 5 * time.Second}
+	parseRobotsTxt("User-agent: *\nDisallow: /private/\n", rules)
+
+	if rules.CrawlDelay != 5*time.Second {
+		t.Errorf("CrawlDelay = %v, want the 5s default to survive an robots.txt with no Crawl-delay", rules.CrawlDelay)
+	}
+}
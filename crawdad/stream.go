@@ -0,0 +1,233 @@
+package crawdad
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Record is one fetched-and-done page handed to a Writer, either live by
+// crawl() as each page completes (Body holds the raw response) or after
+// the fact by DumpStream (Body is nil, since raw bodies aren't
+// persisted to the 'done' queue).
+type Record struct {
+	URL       string
+	Plucked   string
+	FetchedAt time.Time
+	Body      []byte
+}
+
+// Writer receives a stream of Records one at a time, so a crawl's
+// results can be serialized without ever holding them all in memory.
+type Writer interface {
+	WriteRecord(Record) error
+	Close() error
+}
+
+// StreamTo attaches w to c so that crawl() hands it every page's
+// Record as soon as the page is marked done, instead of buffering
+// results in memory until the crawl finishes. Call it before Crawl();
+// w is closed automatically when the crawl stops.
+func (c *Crawler) StreamTo(w Writer) {
+	c.stream = newStreamPipeline(w, c.log)
+}
+
+// DumpStream streams every 'done' page through w, without loading the
+// whole crawl into memory the way DumpMap does. Records built this way
+// have no Body, since raw response bodies aren't kept in the 'done'
+// queue; use StreamTo for a writer that needs them.
+func (c *Crawler) DumpStream(w Writer) error {
+	keys, err := c.done.Scan()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		val, getErr := c.done.Get(key)
+		if getErr != nil {
+			continue
+		}
+		plucked := val
+		if c.Settings.DedupContent {
+			var rec doneRecord
+			if jsonErr := json.Unmarshal([]byte(val), &rec); jsonErr == nil {
+				plucked = rec.Plucked
+			}
+		}
+		if err = w.WriteRecord(Record{URL: key, Plucked: plucked}); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// streamPipeline decouples crawl() from a Writer's I/O: records are
+// handed off over a channel and written by a single background
+// goroutine, so a slow writer only blocks a worker once 100 records are
+// waiting to be written.
+type streamPipeline struct {
+	w       Writer
+	log     *zap.SugaredLogger
+	records chan Record
+	done    chan struct{}
+}
+
+func newStreamPipeline(w Writer, log *zap.SugaredLogger) *streamPipeline {
+	p := &streamPipeline{
+		w:       w,
+		log:     log,
+		records: make(chan Record, 100),
+		done:    make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *streamPipeline) run() {
+	defer close(p.done)
+	for rec := range p.records {
+		if err := p.w.WriteRecord(rec); err != nil {
+			p.log.Errorf("stream: problem writing record for %s: %s", rec.URL, err.Error())
+		}
+	}
+	if err := p.w.Close(); err != nil {
+		p.log.Errorf("stream: problem closing writer: %s", err.Error())
+	}
+}
+
+func (p *streamPipeline) record(rec Record) {
+	p.records <- rec
+}
+
+func (p *streamPipeline) close() {
+	close(p.records)
+	<-p.done
+}
+
+// NDJSONWriter writes one {url, plucked, fetched_at} JSON object per
+// line.
+type NDJSONWriter struct {
+	enc *json.Encoder
+}
+
+// NewNDJSONWriter returns a Writer that streams NDJSON to w.
+func NewNDJSONWriter(w io.Writer) *NDJSONWriter {
+	return &NDJSONWriter{enc: json.NewEncoder(w)}
+}
+
+func (n *NDJSONWriter) WriteRecord(rec Record) error {
+	return n.enc.Encode(struct {
+		URL       string    `json:"url"`
+		Plucked   string    `json:"plucked"`
+		FetchedAt time.Time `json:"fetched_at"`
+	}{rec.URL, rec.Plucked, rec.FetchedAt})
+}
+
+func (n *NDJSONWriter) Close() error { return nil }
+
+// CSVWriter writes one "url,plucked,fetched_at" row per record, with a
+// header row written up front.
+type CSVWriter struct {
+	cw *csv.Writer
+}
+
+// NewCSVWriter returns a Writer that streams CSV to w.
+func NewCSVWriter(w io.Writer) *CSVWriter {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"url", "plucked", "fetched_at"})
+	return &CSVWriter{cw: cw}
+}
+
+func (c *CSVWriter) WriteRecord(rec Record) error {
+	if err := c.cw.Write([]string{rec.URL, rec.Plucked, rec.FetchedAt.Format(time.RFC3339)}); err != nil {
+		return err
+	}
+	c.cw.Flush()
+	return c.cw.Error()
+}
+
+func (c *CSVWriter) Close() error {
+	c.cw.Flush()
+	return c.cw.Error()
+}
+
+// WARCWriter emits ISO-28500 WARC records, so a crawl can be replayed
+// with standard web-archive tooling. The first call to WriteRecord also
+// emits a leading "warcinfo" record, per convention.
+type WARCWriter struct {
+	w         io.Writer
+	wroteInfo bool
+}
+
+// NewWARCWriter returns a Writer that streams WARC records to w. Wrap w
+// in a gzip.Writer first for the usual ".warc.gz" on-disk format.
+func NewWARCWriter(w io.Writer) *WARCWriter {
+	return &WARCWriter{w: w}
+}
+
+func (ww *WARCWriter) WriteRecord(rec Record) error {
+	if !ww.wroteInfo {
+		if err := ww.writeWarcinfo(); err != nil {
+			return err
+		}
+		ww.wroteInfo = true
+	}
+	return ww.writeRecord("response", rec.URL, rec.FetchedAt, "application/http; msgtype=response", warcHTTPPayload(rec.Body))
+}
+
+func (ww *WARCWriter) Close() error { return nil }
+
+func (ww *WARCWriter) writeWarcinfo() error {
+	payload := []byte("software: crawdad\r\nformat: WARC File Format 1.0\r\n")
+	return ww.writeRecord("warcinfo", "", time.Now(), "application/warc-fields", payload)
+}
+
+func (ww *WARCWriter) writeRecord(recordType, targetURI string, date time.Time, contentType string, payload []byte) error {
+	if date.IsZero() {
+		date = time.Now()
+	}
+	var header bytes.Buffer
+	header.WriteString("WARC/1.0\r\n")
+	fmt.Fprintf(&header, "WARC-Type: %s\r\n", recordType)
+	if targetURI != "" {
+		fmt.Fprintf(&header, "WARC-Target-URI: %s\r\n", targetURI)
+	}
+	fmt.Fprintf(&header, "WARC-Date: %s\r\n", date.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&header, "WARC-Record-ID: <urn:uuid:%s>\r\n", newWarcRecordID())
+	fmt.Fprintf(&header, "Content-Type: %s\r\n", contentType)
+	fmt.Fprintf(&header, "Content-Length: %d\r\n", len(payload))
+	header.WriteString("\r\n")
+
+	if _, err := ww.w.Write(header.Bytes()); err != nil {
+		return err
+	}
+	if _, err := ww.w.Write(payload); err != nil {
+		return err
+	}
+	_, err := ww.w.Write([]byte("\r\n\r\n"))
+	return err
+}
+
+// warcHTTPPayload wraps body in a minimal synthetic HTTP/1.1 response,
+// since a WARC "response" record's payload is the raw HTTP response
+// rather than just the body; crawdad doesn't keep the original response
+// headers around, so a bare 200 status line stands in for them.
+func warcHTTPPayload(body []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("HTTP/1.1 200 OK\r\n\r\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+func newWarcRecordID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}